@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ChartAxisLeft string = "LEFT"
+	ChartAxisRight string = "RIGHT"
+
+	DefaultChartLength int = 8 // values per line without a time window
+	MaxChartPoints int = 300 // values per line, windows are split into as many buckets
+	MaxChartScan int = 50000 // data logs read per series of a time window
+)
+
+// Live streams send a changed chart at most this often, every update reads
+// its data logs again.
+const ChartRefreshInterval = time.Second
+
+// ChartDataset is a line of the chart, its values belong to the timestamps
+// of the chart data.
+type ChartDataset struct {
+	Label string
+	Color string
+	Axis string
+	Values []any
+}
+
+// Reads the chart specific fields of the widget forms. The dashboard forms
+// send one series-* field per series, the explorer a single topic.
+func parseChartForm(r *http.Request) (TimeseriesLineChartWidgetConfig, error) {
+	config := TimeseriesLineChartWidgetConfig{}
+
+	if err := r.ParseForm(); err != nil {
+		return config, err
+	}
+
+	topics, found := r.Form["series-topic"]
+	if !found {
+		topics = []string{r.FormValue("topic")}
+	}
+
+	for i, topic := range topics {
+		series := ChartSeries{
+			Topic: strings.TrimSpace(topic),
+			ValuePath: chartFormValue(r, found, "value-path", i),
+			Transform: chartFormValue(r, found, "transform", i),
+			Label: strings.TrimSpace(chartFormValue(r, found, "label", i)),
+			Color: strings.TrimSpace(chartFormValue(r, found, "color", i)),
+			Axis: chartFormValue(r, found, "axis", i),
+		}
+		if series.Topic == "" {
+			continue
+		}
+		if series.Axis == "" {
+			series.Axis = ChartAxisLeft
+		}
+
+		if err := validateTopicFilter(series.Topic); err != nil {
+			return config, err
+		}
+		if _, err := parseValuePath(series.ValuePath); err != nil {
+			return config, fmt.Errorf("%s: %w", series.Topic, err)
+		}
+		if _, err := compileExpression(series.Transform); err != nil {
+			return config, fmt.Errorf("%s: %w", series.Topic, err)
+		}
+		if series.Color != "" && !colorPattern.MatchString(series.Color) {
+			return config, fmt.Errorf("%s: invalid color %q", series.Topic, series.Color)
+		}
+		if series.Axis != ChartAxisLeft && series.Axis != ChartAxisRight {
+			return config, fmt.Errorf("%s: invalid axis %q", series.Topic, series.Axis)
+		}
+
+		config.Series = append(config.Series, series)
+	}
+
+	if len(config.Series) == 0 {
+		return config, fmt.Errorf("at least one series is required")
+	}
+
+	maxLength, err := parseNumberField(r.FormValue("max-length"), float64(DefaultChartLength))
+	if err != nil || maxLength != math.Trunc(maxLength) || maxLength < 1 || maxLength > float64(MaxChartPoints) {
+		return config, fmt.Errorf("number of values must be a whole number from 1 to %d", MaxChartPoints)
+	}
+	config.MaxLength = int(maxLength)
+
+	window, err := parseNumberField(r.FormValue("window"), 0)
+	if err != nil || window != math.Trunc(window) || window < 0 {
+		return config, fmt.Errorf("time window must be a whole number of seconds")
+	}
+	config.Window = int(window)
+
+	return config, nil
+}
+
+// Returns the i-th value of the series field, or the single series field of
+// the explorer form.
+func chartFormValue(r *http.Request, multiple bool, key string, i int) string {
+	if !multiple {
+		return r.FormValue(key)
+	}
+
+	values := r.Form["series-" + key]
+	if i < len(values) {
+		return values[i]
+	}
+
+	return ""
+}
+
+// Moves the single series of charts saved before multiple series into
+// Series.
+func (c *TimeseriesLineChartWidgetConfig) migrate() {
+	if len(c.Series) == 0 && c.Topic != "" {
+		c.Series = []ChartSeries{{
+			Topic: c.Topic,
+			ValuePath: c.ValuePath,
+			Transform: c.Transform,
+			Label: c.Label,
+			Axis: ChartAxisLeft,
+		}}
+	}
+	c.Topic, c.ValuePath, c.Transform, c.Label = "", "", "", ""
+
+	if c.MaxLength == 0 {
+		c.MaxLength = DefaultChartLength
+	}
+}
+
+// Returns the topics of the series.
+func (c TimeseriesLineChartWidgetConfig) Topics() []string {
+	var topics []string
+	for _, series := range c.Series {
+		topics = append(topics, series.Topic)
+	}
+
+	return topics
+}
+
+// Builds one dataset per series, or per matching topic of filter series, and
+// aligns their values on the timestamps of all datasets. Transforms are the
+// compiled transforms of the series.
+func getChartData(db *sql.DB, projectID int, decoders *PayloadDecoders, config TimeseriesLineChartWidgetConfig, transforms []*Expression) (TimeseriesLineChartWidgetData, error) {
+	type chartLine struct {
+		dataset ChartDataset
+		dataLogs []DataLog
+		series ChartSeries
+		transform *Expression
+	}
+
+	var lines []chartLine
+	timestamps := map[int64]int{}
+	for i, series := range config.Series {
+		topics, dataLogs, err := getSeriesDataLogs(db, projectID, config, series.Topic)
+		if err != nil {
+			return TimeseriesLineChartWidgetData{}, err
+		}
+
+		for _, topic := range topics {
+			label := series.Label
+			if label == "" {
+				label = topic
+			} else if isTopicFilter(series.Topic) {
+				label += " (" + topic + ")"
+			}
+
+			lines = append(lines, chartLine{
+				dataset: ChartDataset{
+					Label: label,
+					Color: series.Color,
+					Axis: series.Axis,
+				},
+				dataLogs: dataLogs[topic],
+				series: series,
+				transform: transforms[i],
+			})
+			for _, dataLog := range dataLogs[topic] {
+				timestamps[dataLog.CreatedAt.UnixMilli()] = 0
+			}
+		}
+	}
+
+	data := TimeseriesLineChartWidgetData{
+		Timestamps: make([]int64, 0, len(timestamps)),
+		Datasets: []ChartDataset{},
+	}
+	for timestamp := range timestamps {
+		data.Timestamps = append(data.Timestamps, timestamp)
+	}
+	slices.Sort(data.Timestamps)
+	for i, timestamp := range data.Timestamps {
+		timestamps[timestamp] = i
+	}
+
+	for _, line := range lines {
+		line.dataset.Values = make([]any, len(data.Timestamps))
+		for _, dataLog := range line.dataLogs {
+			line.dataset.Values[timestamps[dataLog.CreatedAt.UnixMilli()]] = chartValue(decoders, dataLog, line.series.ValuePath, line.transform)
+		}
+		data.Datasets = append(data.Datasets, line.dataset)
+	}
+
+	return data, nil
+}
+
+// Returns the data logs of each topic matching the series topic, newest
+// first, and the topics in the order they were last seen. Without a window
+// a topic has up to MaxLength data logs, within a window the newest one of
+// each of MaxChartPoints buckets.
+func getSeriesDataLogs(db *sql.DB, projectID int, config TimeseriesLineChartWidgetConfig, filter string) ([]string, map[string][]DataLog, error) {
+	var since time.Time
+	var bucket time.Duration
+	limit := config.MaxLength
+	maxScan := config.MaxLength * MaxChartSeries
+	if config.Window > 0 {
+		window := time.Duration(config.Window) * time.Second
+		since = time.Now().Add(-window)
+		bucket = max(window / time.Duration(MaxChartPoints), time.Millisecond)
+		limit = MaxChartPoints + 1
+		maxScan = MaxChartScan
+	}
+
+	var topics []string
+	dataLogs := map[string][]DataLog{}
+	buckets := map[string]time.Duration{}
+	scanned := 0
+	err := scanDataLogs(db, projectID, filter, func(dataLog DataLog) bool {
+		scanned++
+		if scanned > maxScan || (config.Window > 0 && dataLog.CreatedAt.Before(since)) {
+			return false
+		}
+
+		topicLogs, found := dataLogs[dataLog.Topic]
+		if !found {
+			if len(topics) == MaxChartSeries {
+				return true
+			}
+			topics = append(topics, dataLog.Topic)
+		}
+		if len(topicLogs) == limit {
+			// filters keep looking for the other topics
+			return isTopicFilter(filter)
+		}
+
+		if bucket > 0 {
+			current := dataLog.CreatedAt.Sub(since) / bucket
+			if found && buckets[dataLog.Topic] == current {
+				return true
+			}
+			buckets[dataLog.Topic] = current
+		}
+
+		dataLogs[dataLog.Topic] = append(topicLogs, dataLog)
+		return true
+	})
+
+	return topics, dataLogs, err
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// ConnectionManager owns the broker connections of all projects, it is safe
+// to use from concurrent HTTP handlers.
+type ConnectionManager struct {
+	mutex sync.Mutex
+	connections map[int]*Connection
+}
+
+func NewConnectionManager() *ConnectionManager {
+	return &ConnectionManager{
+		connections: make(map[int]*Connection),
+	}
+}
+
+// Returns the connection of the project, nil when it was never connected.
+func (m *ConnectionManager) Get(projectID int) *Connection {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.connections[projectID]
+}
+
+// Must be called while holding the mutex.
+func (m *ConnectionManager) getOrCreate(projectID int) *Connection {
+	connection, found := m.connections[projectID]
+	if !found {
+		connection = &Connection{
+			ProjectID: projectID,
+			Status: ConnectionOffline,
+		}
+		m.connections[projectID] = connection
+	}
+
+	return connection
+}
+
+// Starts connecting the project in the background unless it is already
+// connected or connecting.
+func (m *ConnectionManager) Connect(db *sql.DB, project *Project, subscriptions map[string]byte) error {
+	tlsConfig, err := newTLSConfig(project)
+	if err != nil {
+		return err
+	}
+
+	headers, err := parseBrokerHeaders(project.BrokerWebSocketHeaders)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	connection := m.getOrCreate(project.ID)
+	if connection.GetStatus() != ConnectionOffline {
+		return nil
+	}
+
+	// pick up the latest broker settings
+	connection.Broker = project.BrokerURL()
+	connection.ClientID = project.BrokerClientID
+	connection.Username = project.BrokerUsername
+	connection.Password = project.BrokerPassword
+	connection.TLSConfig = tlsConfig
+	connection.HTTPHeaders = headers
+	connection.BufferDepth = project.BufferDepth
+	connection.BufferMaxBytes = project.BufferMaxBytes
+	connection.ProtocolVersion = project.BrokerProtocolVersion
+	connection.Sparkplug = project.SparkplugEnabled
+	connection.Will = LifecycleMessage{
+		Topic: project.WillTopic,
+		Payload: project.WillPayload,
+		QoS: project.WillQoS,
+		Retain: project.WillRetain,
+	}
+	connection.Birth = LifecycleMessage{
+		Topic: project.BirthTopic,
+		Payload: project.BirthPayload,
+		QoS: project.BirthQoS,
+		Retain: project.BirthRetain,
+	}
+
+	// claim the connection before releasing the lock, so parallel requests
+	// do not start a second client
+	connection.setStatus(db, ConnectionConnecting, LogInfo, "Connecting to " + connection.Broker)
+
+	go func() {
+		// failures are recorded in the project logs
+		connection.Connect(db, subscriptions)
+	}()
+
+	return nil
+}
+
+func (m *ConnectionManager) Disconnect(db *sql.DB, projectID int) {
+	connection := m.Get(projectID)
+	if connection == nil || connection.GetStatus() == ConnectionOffline {
+		return
+	}
+
+	go connection.Disconnect(db)
+}
+
+// Returns the connection state of the project as text, e.g. "online".
+func (m *ConnectionManager) StatusText(projectID int) string {
+	connection := m.Get(projectID)
+	if connection == nil {
+		return "offline"
+	}
+
+	return connection.StatusText()
+}
+
+func (m *ConnectionManager) Subscribe(projectID int, topic string, qos byte) error {
+	connection := m.Get(projectID)
+	if connection == nil {
+		return nil
+	}
+
+	return connection.Subscribe(topic, qos)
+}
+
+func (m *ConnectionManager) Unsubscribe(projectID int, topic string) error {
+	connection := m.Get(projectID)
+	if connection == nil {
+		return nil
+	}
+
+	return connection.Unsubscribe(topic)
+}
+
+// Subscribes the project to the filter of the topic explorer, nothing is
+// subscribed when the project was never connected.
+func (m *ConnectionManager) Explore(projectID int, filter string) error {
+	connection := m.Get(projectID)
+	if connection == nil {
+		return nil
+	}
+
+	return connection.Explore(filter)
+}
+
+func (m *ConnectionManager) TopicTree(projectID int) []TopicTreeNode {
+	connection := m.Get(projectID)
+	if connection == nil {
+		return []TopicTreeNode{}
+	}
+
+	return connection.TopicTree()
+}
+
+// Returns the last message received on the topic of the project.
+func (m *ConnectionManager) LatestMessage(projectID int, topic string) (Message, bool) {
+	connection := m.Get(projectID)
+	if connection == nil {
+		return Message{}, false
+	}
+
+	return connection.LatestMessage(topic)
+}
+
+func (m *ConnectionManager) BufferUsage(projectID int) BufferUsage {
+	connection := m.Get(projectID)
+	if connection == nil {
+		return BufferUsage{}
+	}
+
+	return connection.BufferUsage()
+}
+
+// Registers a listener for the events of the project, it keeps working when
+// the project connects later on.
+func (m *ConnectionManager) Listen(projectID int) (*Connection, chan ConnectionEvent, func()) {
+	m.mutex.Lock()
+	connection := m.getOrCreate(projectID)
+	m.mutex.Unlock()
+
+	events, cancel := connection.Listen()
+	return connection, events, cancel
+}
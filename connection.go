@@ -1,106 +1,650 @@
 package main
 
 import (
+	"crypto/tls"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"maps"
+	"net/http"
 	"slices"
+	"strings"
+	"sync"
+	"time"
+)
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+const (
+	ConnectionOffline int = iota
+	ConnectionOnline
+	ConnectionConnecting
+	ConnectionReconnecting
 )
 
+// Connection is shared between HTTP handlers and paho callbacks, every field
+// below mutex must be accessed while holding it.
 type Connection struct {
 	ProjectID int
-	Status int // 0: offline, 1: online
 	Broker string
 	ClientID string
-	Client mqtt.Client
-	Topics []string
-	DataBuffer map[string][][]byte
+	Username string
+	Password string
+	TLSConfig *tls.Config
+	HTTPHeaders http.Header
+	BufferDepth int
+	BufferMaxBytes int
+	ProtocolVersion int // MQTTVersion311 or MQTTVersion5
+	Will LifecycleMessage
+	Birth LifecycleMessage
+	Sparkplug bool // decode Sparkplug B messages into metric topics
+
+	mutex sync.RWMutex
+	Status int // one of the Connection* states
+	Client mqttClient
+	Subscriptions map[string]byte // topic to QoS
+	DataBuffer map[string]*TopicBuffer
+	Topics *TopicTree // every topic seen since connecting
+	explorerFilter string
+	explorerSeenAt time.Time // last call of Explore
+	explorerTimer *time.Timer // unsubscribes the explorer filter once unused
+	listeners map[chan ConnectionEvent]bool
+	requests map[string]pendingRequest // by correlation ID
+	requestResults map[int]RequestResult // by widget ID
+	switchCommands map[int]switchCommand // by widget ID
+	sparkplug *SparkplugNetwork // nil unless Sparkplug is enabled
 }
 
-func init() {
-	mqtt.ERROR = log.New(os.Stdout, "[ERROR] ", 0)
-	mqtt.CRITICAL = log.New(os.Stdout, "[CRIT] ", 0)
-	mqtt.WARN = log.New(os.Stdout, "[WARN]  ", 0)
-	mqtt.DEBUG = log.New(os.Stdout, "[DEBUG] ", 0)
+// LifecycleMessage is published when the client connects or disconnects, an
+// empty topic disables it.
+type LifecycleMessage struct {
+	Topic string
+	Payload string
+	QoS byte
+	Retain bool
 }
 
-func (c *Connection) Connect(db *sql.DB) error {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(c.Broker)
-	opts.SetClientID(c.ClientID)
-	//opts.SetUsername("emqx")
-	//opts.SetPassword("public")
+// Explorer pages poll every 2 seconds and console streams ping every 15
+// seconds, both renew the explorer subscription.
+const ExplorerLease = 30 * time.Second
 
-	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-		fmt.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
+const (
+	EventStatus string = "status"
+	EventMessage string = "message"
+	EventRequest string = "request"
+	EventSwitch string = "switch"
+)
 
-		// Register to the database
-		createDataLog(db, msg.Topic(), msg.Payload())
+// ConnectionEvent is delivered to listeners when the connection state changes,
+// a message arrives, a request widget got its result or a switch widget
+// sent a command.
+type ConnectionEvent struct {
+	Type string
+	Status string
+	Message Message
+	WidgetID int
+}
 
-		if len(c.DataBuffer) == 0 {
-			c.DataBuffer = make(map[string][][]byte)
-		}
+// Connects to the broker and subscribes to the given topics with their QoS,
+// the topics are subscribed again every time the client reconnects.
+func (c *Connection) Connect(db *sql.DB, subscriptions map[string]byte) error {
+	var client mqttClient
+	client = newMQTTClient(c, clientHandlers{
+		OnConnect: func() {
+			c.setStatus(db, ConnectionOnline, LogInfo, "Connected to " + c.Broker)
 
-		if _, exists := c.DataBuffer[msg.Topic()]; exists {
-			c.DataBuffer[msg.Topic()] = append(c.DataBuffer[msg.Topic()], msg.Payload())
-		} else {
-			c.DataBuffer[msg.Topic()] = [][]byte{
-				msg.Payload(),
+			if c.Birth.Topic != "" {
+				err := client.Publish(Message{
+					Topic: c.Birth.Topic,
+					Payload: []byte(c.Birth.Payload),
+					QoS: c.Birth.QoS,
+					Retained: c.Birth.Retain,
+				})
+				if err != nil {
+					createLog(db, c.ProjectID, LogError, fmt.Sprintf("Unable to publish birth message to %s: %v", c.Birth.Topic, err))
+				}
 			}
-		}
+
+			// clean sessions drop subscriptions, so restore them on every connect
+			c.mutex.RLock()
+			subscriptions := maps.Clone(c.Subscriptions)
+			c.mutex.RUnlock()
+
+			for topic, qos := range subscriptions {
+				if isSparkplugTopic(topic) {
+					continue
+				}
+				if err := client.Subscribe(topic, qos); err != nil {
+					createLog(db, c.ProjectID, LogError, fmt.Sprintf("Unable to subscribe to %s: %v", topic, err))
+					continue
+				}
+				fmt.Printf("Subscribed to topic: %s\n", topic)
+			}
+
+			c.mutex.RLock()
+			explorerFilter := c.explorerFilter
+			_, used := subscriptions[explorerFilter]
+			c.mutex.RUnlock()
+
+			if explorerFilter != "" && !used && !isSparkplugTopic(explorerFilter) {
+				if err := client.Subscribe(explorerFilter, 0); err != nil {
+					createLog(db, c.ProjectID, LogError, fmt.Sprintf("Unable to subscribe to %s: %v", explorerFilter, err))
+				}
+			}
+		},
+		OnConnectionLost: func(err error) {
+			c.setStatus(db, ConnectionReconnecting, LogWarning, fmt.Sprintf("Connection lost: %v", err))
+		},
+		OnReconnecting: func() {
+			c.setStatus(db, ConnectionReconnecting, LogInfo, "Reconnecting to " + c.Broker)
+		},
+		OnMessage: func(message Message) {
+			fmt.Printf("Received message: %s from topic: %s\n", message.Payload, message.Topic)
+
+			c.receive(db, message)
+
+			c.mutex.Lock()
+			var metrics []Message
+			var err error
+			if c.sparkplug != nil && strings.HasPrefix(message.Topic, sparkplugNamespace + "/") {
+				metrics, err = c.sparkplug.Handle(message)
+			}
+			c.mutex.Unlock()
+
+			if err != nil {
+				createLog(db, c.ProjectID, LogWarning, err.Error())
+			}
+			for _, metric := range metrics {
+				c.receive(db, metric)
+			}
+		},
 	})
 
-	c.Client = mqtt.NewClient(opts)
-	if token := c.Client.Connect(); token.Wait() && token.Error() != nil {
-		return token.Error()
+	c.mutex.Lock()
+	c.Client = client
+	c.Subscriptions = maps.Clone(subscriptions)
+	c.DataBuffer = nil // buffers are sized by the current settings
+	c.Topics = nil
+	c.explorerFilter = ""
+	c.sparkplug = nil
+	if c.Sparkplug {
+		c.sparkplug = NewSparkplugNetwork()
+		if c.Subscriptions == nil {
+			c.Subscriptions = make(map[string]byte)
+		}
+		c.Subscriptions[sparkplugTopicFilter] = 0
 	}
+	c.mutex.Unlock()
 
-	c.Status = 1
-	c.Topics = nil
+	c.setStatus(db, ConnectionConnecting, LogInfo, "Connecting to " + c.Broker)
+
+	if err := client.Connect(); err != nil {
+		c.setStatus(db, ConnectionOffline, LogError, fmt.Sprintf("Unable to connect to %s: %v", c.Broker, err))
+		return err
+	}
 
 	log.Printf("Connected to MQTT broker: %s\n", c.Broker)
 	return nil
 }
 
-func (c *Connection) Subscribe(topic string) {
-	if slices.Contains(c.Topics, topic) {
-		return
+// Stores a received or decoded message and passes it to the listeners.
+func (c *Connection) receive(db *sql.DB, message Message) {
+	// only topics of widgets are written to the database, the traffic of the
+	// explorer stays in memory
+	if c.persists(message.Topic) {
+		if err := createDataLog(db, c.ProjectID, message.Topic, message.Payload, message.Properties); err != nil {
+			log.Println("Unable to write data log:", err)
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.DataBuffer == nil {
+		c.DataBuffer = make(map[string]*TopicBuffer)
+	}
+
+	buffer, exists := c.DataBuffer[message.Topic]
+	if !exists {
+		buffer = NewTopicBuffer(c.BufferDepth, c.BufferMaxBytes)
+		c.DataBuffer[message.Topic] = buffer
+	}
+	buffer.Push(message)
+	c.matchRequest(message)
+
+	if c.Topics == nil {
+		c.Topics = NewTopicTree()
+	}
+	c.Topics.Add(message)
+
+	c.notify(ConnectionEvent{
+		Type: EventMessage,
+		Message: message,
+	})
+}
+
+// Reports whether a widget subscribed to the topic, the Sparkplug namespace
+// is subscribed to decode the metrics only.
+func (c *Connection) persists(topic string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for filter := range c.Subscriptions {
+		if filter != sparkplugTopicFilter && topicMatches(filter, topic) {
+			return true
+		}
 	}
 
-	if token := c.Client.Subscribe(topic, 0, nil); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
+	return false
+}
+
+// Records a state transition in the project logs, repeated states are not
+// logged again.
+func (c *Connection) setStatus(db *sql.DB, status int, logType int, text string) {
+	c.mutex.Lock()
+	if c.Status == status {
+		c.mutex.Unlock()
 		return
 	}
-	c.Topics = append(c.Topics, topic)
+	c.Status = status
+	c.notify(ConnectionEvent{
+		Type: EventStatus,
+		Status: c.statusText(),
+	})
+	c.mutex.Unlock()
+
+	createLog(db, c.ProjectID, logType, text)
+}
+
+// Registers a listener for connection events, the returned function removes
+// it again. Events are dropped for listeners that do not keep up.
+func (c *Connection) Listen() (chan ConnectionEvent, func()) {
+	events := make(chan ConnectionEvent, 64)
+
+	c.mutex.Lock()
+	if c.listeners == nil {
+		c.listeners = make(map[chan ConnectionEvent]bool)
+	}
+	c.listeners[events] = true
+	c.mutex.Unlock()
+
+	return events, func() {
+		c.mutex.Lock()
+		delete(c.listeners, events)
+		c.mutex.Unlock()
+	}
+}
+
+// Must be called while holding the mutex.
+func (c *Connection) notify(event ConnectionEvent) {
+	for listener := range c.listeners {
+		select {
+		case listener <- event:
+		default:
+		}
+	}
+}
+
+func (c *Connection) GetStatus() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.Status
+}
+
+func (c *Connection) StatusText() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.statusText()
+}
+
+// Must be called while holding the mutex.
+func (c *Connection) statusText() string {
+	switch c.Status {
+	case ConnectionOnline:
+		return "online"
+	case ConnectionConnecting:
+		return "connecting"
+	case ConnectionReconnecting:
+		return "reconnecting"
+	}
+
+	return "offline"
+}
+
+// Returns the last message received on the topic, for topic filters the
+// newest message of all matching topics.
+func (c *Connection) LatestMessage(topic string) (Message, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if !isTopicFilter(topic) {
+		buffer, exists := c.DataBuffer[topic]
+		if !exists {
+			return Message{}, false
+		}
+
+		return buffer.Latest()
+	}
+
+	var latest Message
+	var found bool
+	for _, message := range c.matchingMessages(topic) {
+		if !found || message.ReceivedAt.After(latest.ReceivedAt) {
+			latest = message
+			found = true
+		}
+	}
+
+	return latest, found
+}
+
+// Returns the buffered messages of the topic, oldest first.
+func (c *Connection) Messages(topic string) []Message {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	buffer, exists := c.DataBuffer[topic]
+	if !exists {
+		return nil
+	}
+
+	return buffer.Messages()
+}
+
+// Returns the last message of every topic matching the filter, sorted by
+// topic.
+func (c *Connection) MatchingMessages(filter string) []Message {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.matchingMessages(filter)
+}
+
+// Must be called while holding the mutex.
+func (c *Connection) matchingMessages(filter string) []Message {
+	messages := []Message{}
+	for topic, buffer := range c.DataBuffer {
+		if !topicMatches(filter, topic) {
+			continue
+		}
+
+		if message, found := buffer.Latest(); found {
+			messages = append(messages, message)
+		}
+	}
+
+	slices.SortFunc(messages, func(a, b Message) int {
+		return strings.Compare(a.Topic, b.Topic)
+	})
+
+	return messages
+}
+
+// Returns how much data the topic buffers currently hold.
+func (c *Connection) BufferUsage() BufferUsage {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	usage := BufferUsage{
+		Topics: len(c.DataBuffer),
+	}
+	for topic, buffer := range c.DataBuffer {
+		usage.Messages += buffer.Len()
+		usage.Bytes += buffer.Bytes() + len(topic)
+	}
+
+	return usage
+}
+
+// Subscribes to the topic, a topic that is already subscribed is only
+// subscribed again when the QoS is raised. Topics are remembered while
+// offline and subscribed on connect.
+func (c *Connection) Subscribe(topic string, qos byte) error {
+	c.mutex.Lock()
+	if current, exists := c.Subscriptions[topic]; exists && current >= qos {
+		c.mutex.Unlock()
+		return nil
+	}
+
+	// remembered topics are subscribed again by the OnConnect handler
+	if c.Subscriptions == nil {
+		c.Subscriptions = make(map[string]byte)
+	}
+	c.Subscriptions[topic] = qos
+	client := c.Client
+	c.mutex.Unlock()
+
+	// Sparkplug metrics are decoded from the spBv1.0 subscription
+	if client == nil || !client.IsConnected() || isSparkplugTopic(topic) {
+		return nil
+	}
+
+	if err := client.Subscribe(topic, qos); err != nil {
+		return fmt.Errorf("unable to subscribe to %s: %w", topic, err)
+	}
 	fmt.Printf("Subscribed to topic: %s\n", topic)
+
+	return nil
 }
 
-func (c *Connection) Unsubscribe(topic string) {
-    if token := c.Client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
-        fmt.Println(token.Error())
-        return
-    }
+// Forgets the topic and unsubscribes from it, unless the explorer shows it.
+// The Sparkplug subscription stays while Sparkplug is enabled.
+func (c *Connection) Unsubscribe(topic string) error {
+	c.mutex.Lock()
+	if c.Sparkplug && topic == sparkplugTopicFilter {
+		c.mutex.Unlock()
+		return nil
+	}
+	delete(c.Subscriptions, topic)
+	explored := c.explorerFilter == topic
+	client := c.Client
+	c.mutex.Unlock()
 
-	for i, v := range c.Topics {
-        if v == topic {
-            c.Topics = append(c.Topics[:i], c.Topics[i+1:]...)
-        }
-    }
+	if client == nil || !client.IsConnected() || isSparkplugTopic(topic) || explored {
+		return nil
+	}
+
+	if err := client.Unsubscribe(topic); err != nil {
+		return fmt.Errorf("unable to unsubscribe from %s: %w", topic, err)
+	}
+	fmt.Printf("Unsubscribed from topic: %s\n", topic)
 
-    fmt.Printf("Unsubscribed from topic: %s\n", topic)
+	return nil
 }
 
-func (c *Connection) SendMessage(topic string, message string) {
-	token := c.Client.Publish(topic, 0, false, message)
-	token.Wait()
-	log.Println("Message published:", message)
+// Subscribes to the filter of the topic explorer. Explorer pages and console
+// streams call it repeatedly, the filter is unsubscribed once no call renewed
+// it for ExplorerLease.
+func (c *Connection) Explore(filter string) error {
+	c.mutex.Lock()
+	c.explorerSeenAt = time.Now()
+	if c.explorerTimer == nil {
+		c.explorerTimer = time.AfterFunc(ExplorerLease, c.expireExplorer)
+	}
+
+	previous := c.explorerFilter
+	if previous == filter {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.explorerFilter = filter
+	_, previousUsed := c.Subscriptions[previous]
+	_, used := c.Subscriptions[filter]
+	client := c.Client
+	c.mutex.Unlock()
+
+	// the OnConnect handler subscribes the filter once connected
+	if client == nil || !client.IsConnected() {
+		return nil
+	}
+
+	if previous != "" && !previousUsed && !isSparkplugTopic(previous) {
+		if err := client.Unsubscribe(previous); err != nil {
+			return fmt.Errorf("unable to unsubscribe from %s: %w", previous, err)
+		}
+	}
+	if !used && !isSparkplugTopic(filter) {
+		if err := client.Subscribe(filter, 0); err != nil {
+			return fmt.Errorf("unable to subscribe to %s: %w", filter, err)
+		}
+	}
+
+	return nil
+}
+
+// Unsubscribes the explorer filter when Explore was not called within the
+// lease, a filter also used by a widget stays subscribed.
+func (c *Connection) expireExplorer() {
+	c.mutex.Lock()
+	if remaining := ExplorerLease - time.Since(c.explorerSeenAt); remaining > 0 {
+		c.explorerTimer.Reset(remaining)
+		c.mutex.Unlock()
+		return
+	}
+
+	filter := c.explorerFilter
+	_, used := c.Subscriptions[filter]
+	client := c.Client
+	c.explorerFilter = ""
+	c.explorerTimer = nil
+	c.mutex.Unlock()
+
+	if filter == "" || used || isSparkplugTopic(filter) || client == nil || !client.IsConnected() {
+		return
+	}
+
+	if err := client.Unsubscribe(filter); err != nil {
+		log.Printf("Unable to unsubscribe from %s: %v\n", filter, err)
+		return
+	}
+	fmt.Printf("Unsubscribed from topic: %s\n", filter)
 }
 
-func (c *Connection) Disconnect() {
-	c.Client.Disconnect(250)
-	c.Status = 0
+// Returns the topic tree built from the messages received since connecting.
+func (c *Connection) TopicTree() []TopicTreeNode {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.Topics == nil {
+		return []TopicTreeNode{}
+	}
+
+	return c.Topics.Snapshot(time.Now())
+}
+
+// Publishes the message and waits for the broker to accept it, MQTT 5
+// properties are dropped on 3.1.1 connections.
+func (c *Connection) SendMessage(message Message) error {
+	c.mutex.RLock()
+	client := c.Client
+	c.mutex.RUnlock()
+
+	if client == nil || !client.IsConnected() {
+		return errors.New("not connected to the broker")
+	}
+
+	if isSparkplugTopic(message.Topic) {
+		command, err := c.sparkplugCommand(message)
+		if err != nil {
+			return err
+		}
+		message = command
+	}
+
+	if err := client.Publish(message); err != nil {
+		return err
+	}
+
+	log.Println("Message published:", string(message.Payload))
+	return nil
+}
+
+// Returns the Sparkplug groups seen since connecting.
+func (c *Connection) SparkplugGroups() []SparkplugGroup {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.sparkplug == nil {
+		return []SparkplugGroup{}
+	}
+
+	return c.sparkplug.Snapshot()
+}
+
+// Turns a message published to a virtual metric topic into the NCMD or DCMD
+// message writing the metric, the payload is parsed with the data type from
+// the birth certificate.
+func (c *Connection) sparkplugCommand(message Message) (Message, error) {
+	topic, metric, err := parseSparkplugMetricTopic(message.Topic)
+	if err != nil {
+		return Message{}, err
+	}
+
+	c.mutex.RLock()
+	var dataType uint32
+	if c.sparkplug != nil {
+		dataType = c.sparkplug.DataType(topic, metric)
+	}
+	c.mutex.RUnlock()
+
+	if dataType == 0 {
+		return Message{}, fmt.Errorf("the data type of %s is unknown, wait for the birth certificate", metric)
+	}
+
+	payload, err := encodeSparkplugCommand(metric, dataType, string(message.Payload))
+	if err != nil {
+		return Message{}, err
+	}
+
+	topic.MessageType = "NCMD"
+	if topic.Device != "" {
+		topic.MessageType = "DCMD"
+	}
+
+	return Message{
+		Topic: topic.String(),
+		Payload: payload,
+		QoS: 0, // Sparkplug commands are sent with QoS 0
+	}, nil
+}
+
+// Asks the edge node to publish its birth certificates again, needed when
+// DATA messages use aliases of a birth sent before connecting.
+func (c *Connection) SparkplugRebirth(group string, node string) error {
+	payload, err := encodeSparkplugCommand("Node Control/Rebirth", sparkplugBoolean, "true")
+	if err != nil {
+		return err
+	}
+
+	return c.SendMessage(Message{
+		Topic: sparkplugTopic{Group: group, MessageType: "NCMD", Node: node}.String(),
+		Payload: payload,
+	})
+}
+
+func (c *Connection) Disconnect(db *sql.DB) {
+	c.mutex.RLock()
+	client := c.Client
+	c.mutex.RUnlock()
+
+	if client != nil {
+		// brokers discard the will on a clean disconnect, so announce it here
+		if c.Will.Topic != "" && client.IsConnected() {
+			err := client.Publish(Message{
+				Topic: c.Will.Topic,
+				Payload: []byte(c.Will.Payload),
+				QoS: c.Will.QoS,
+				Retained: c.Will.Retain,
+			})
+			if err != nil {
+				createLog(db, c.ProjectID, LogWarning, fmt.Sprintf("Unable to publish offline message to %s: %v", c.Will.Topic, err))
+			}
+		}
+
+		client.Disconnect()
+	}
+
+	c.setStatus(db, ConnectionOffline, LogInfo, "Disconnected from " + c.Broker)
 	log.Printf("Disconnected from MQTT broker: %s\n", c.Broker)
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+var consolePayloadFormats = []string{"text", "json", "hex", "base64"}
+
+type ProjectConsoleViewData struct {
+	Project *Project
+	PayloadFormats []string
+}
+
+func projectConsoleHandler(db *sql.DB, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		tmpl := template.Must(template.ParseFiles("./views/layout.html", "./views/project-console.html"))
+		tmpl.Execute(w, ProjectConsoleViewData{
+			Project: project,
+			PayloadFormats: consolePayloadFormats,
+		})
+	}
+}
+
+// Publishes the message of the console form, the answer is "OK" or the
+// error text.
+func projectConsolePublishHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			fmt.Fprintf(w, "Only POST method is supported.")
+			return
+		}
+
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		topic := r.FormValue("topic")
+		if topic == "" {
+			http.Error(w, "ERROR: topic is required", http.StatusBadRequest)
+			return
+		}
+		if err := validatePublishTopic(topic); err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		qos, err := parseQoS(r.FormValue("qos"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		payload, err := decodeConsolePayload(r.FormValue("format"), r.FormValue("payload"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		connection := connections.Get(project.ID)
+		if connection == nil {
+			http.Error(w, "ERROR: not connected to the broker", http.StatusBadGateway)
+			return
+		}
+
+		err = connection.SendMessage(Message{
+			Topic: topic,
+			Payload: payload,
+			QoS: qos,
+			Retained: r.FormValue("retain") == "on",
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		fmt.Fprint(w, "OK")
+	}
+}
+
+// Streams every incoming message matching the filter query parameter as
+// Server-Sent Events. The project is subscribed to its explorer filter, so
+// the console sees more than the widget topics.
+func projectConsoleEventsHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		filter := r.URL.Query().Get("filter")
+		if filter == "" {
+			filter = "#"
+		}
+		if err := validateTopicFilter(filter); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		decoders, err := newPayloadDecoders(project)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		connection, events, cancel := connections.Listen(project.ID)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		status := connection.StatusText()
+		if status == "online" {
+			if err := connection.Explore(project.ExplorerFilter); err != nil {
+				writeEvent(w, "error", err.Error())
+			}
+		}
+		writeEvent(w, "status", status)
+		flusher.Flush()
+
+		pingTicker := time.NewTicker(15 * time.Second)
+		defer pingTicker.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-events:
+				switch event.Type {
+				case EventStatus:
+					// connecting drops the explorer subscription
+					if event.Status == "online" {
+						if err := connection.Explore(project.ExplorerFilter); err != nil {
+							writeEvent(w, "error", err.Error())
+						}
+					}
+					writeEvent(w, "status", event.Status)
+				case EventMessage:
+					if !topicMatches(filter, event.Message.Topic) {
+						continue
+					}
+
+					message := SocketMessage{
+						Topic: event.Message.Topic,
+						Payload: string(event.Message.Payload),
+						QoS: event.Message.QoS,
+						Retained: event.Message.Retained,
+						Properties: event.Message.Properties,
+						ReceivedAt: event.Message.ReceivedAt,
+					}
+					if decoders.Matches(message.Topic) {
+						decoded, err := decoders.Decode(message.Topic, event.Message.Payload)
+						if err != nil {
+							message.Decoded = "ERROR: " + err.Error()
+						} else {
+							message.Decoded = string(decoded)
+						}
+					}
+
+					writeEvent(w, "message", message)
+				default:
+					continue
+				}
+				flusher.Flush()
+			case <-pingTicker.C:
+				// keeps the explorer filter subscribed while the console is open
+				if err := connection.Explore(project.ExplorerFilter); err != nil {
+					writeEvent(w, "error", err.Error())
+				}
+				fmt.Fprint(w, ": ping\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// Converts the payload typed into the console to the bytes to publish.
+func decodeConsolePayload(format string, payload string) ([]byte, error) {
+	switch format {
+	case "", "text":
+		return []byte(payload), nil
+	case "json":
+		if !json.Valid([]byte(payload)) {
+			return nil, errors.New("payload is not valid JSON")
+		}
+		return []byte(payload), nil
+	case "hex":
+		// spaces and line breaks between bytes are allowed
+		data, err := hex.DecodeString(strings.Join(strings.Fields(payload), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex payload: %w", err)
+		}
+		return data, nil
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(payload))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 payload: %w", err)
+		}
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("unknown payload format %q", format)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// Key used to encrypt broker secrets (passwords, private keys) before they
+// are written to the database. It is read from the MQTT_STUDIO_SECRET_KEY
+// environment variable, or generated once and kept in ./secret.key.
+var secretKey []byte
+
+func loadSecretKey() {
+	if value := os.Getenv("MQTT_STUDIO_SECRET_KEY"); value != "" {
+		sum := sha256.Sum256([]byte(value))
+		secretKey = sum[:]
+		return
+	}
+
+	key, err := os.ReadFile("./secret.key")
+	if err == nil && len(key) == 32 {
+		secretKey = key
+		return
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatalln("Unable to read secret key", err.Error())
+	}
+
+	key = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		log.Fatalln("Unable to generate secret key", err.Error())
+	}
+
+	if err := os.WriteFile("./secret.key", key, 0600); err != nil {
+		log.Fatalln("Unable to write secret key", err.Error())
+	}
+
+	log.Println("Generated a new secret key in ./secret.key")
+	secretKey = key
+}
+
+func EncryptSecret(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func DecryptSecret(ciphertext string) (string, error) {
+	if ciphertext == "" {
+		return "", nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("secret is too short")
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
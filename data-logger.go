@@ -2,22 +2,28 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
+	"strings"
 	"time"
 )
 
 type DataLog struct {
 	ID			int
+	ProjectID	int
 	Topic		string
 	Data		[]byte
+	Properties	[]byte // MessageProperties as JSON, empty without MQTT 5 properties
 	CreatedAt	time.Time
 }
 
 func createDataLogsTable(db *sql.DB) {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS data_logs(
 		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		project_id INTEGER NOT NULL DEFAULT 0,
 		topic TEXT NOT NULL,
 		data BLOB,
+		properties TEXT NOT NULL DEFAULT '',
 		created_at DATETIME
 	);`)
 	if err != nil {
@@ -26,45 +32,151 @@ func createDataLogsTable(db *sql.DB) {
 	}
 }
 
-func createDataLog(db *sql.DB, topic string, data []byte) {
-	stmt, err := db.Prepare("INSERT INTO data_logs(topic, data, created_at) VALUES(?,?,?)")
+// Brings data_logs tables of older databases up to date.
+func migrateDataLogsTable(db *sql.DB) {
+	addColumnIfNotExists(db, "data_logs", "properties", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "data_logs", "project_id", "INTEGER NOT NULL DEFAULT 0")
+	assignDataLogsToProjects(db)
+
+	// charts and widgets read the newest data logs of a topic in a project
+	_, err := db.Exec("DROP INDEX IF EXISTS data_logs_topic_id")
 	if err != nil {
-		log.Fatal(err)
-		return
+		log.Fatalln("Unable to drop data_logs index", err.Error())
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS data_logs_project_topic_id ON data_logs(project_id, topic, id)")
+	if err != nil {
+		log.Fatalln("Unable to create data_logs index", err.Error())
 	}
+}
 
-	res, err := stmt.Exec(topic, data, time.Now())
+// Data logs recorded before they were kept per project have project ID 0.
+// Each one is given to the projects whose widgets subscribe to its topic, the
+// first of them keeps the row and the others get a copy. Rows of topics no
+// widget uses anymore stay unassigned.
+func assignDataLogsToProjects(db *sql.DB) {
+	rows, err := db.Query("SELECT DISTINCT topic FROM data_logs WHERE project_id = 0")
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalln("Unable to read unassigned data logs", err.Error())
+	}
+	var topics []string
+	for rows.Next() {
+		var topic string
+		if err = rows.Scan(&topic); err != nil {
+			log.Fatalln("Unable to read unassigned data logs", err.Error())
+		}
+		topics = append(topics, topic)
+	}
+	rows.Close()
+
+	if len(topics) == 0 {
 		return
 	}
 
-	_, err = res.LastInsertId()
+	rows, err = db.Query("SELECT id FROM projects ORDER BY id")
 	if err != nil {
-		log.Fatal(err)
-		return
+		log.Fatalln("Unable to read projects", err.Error())
+	}
+	var projectIDs []int
+	for rows.Next() {
+		var projectID int
+		if err = rows.Scan(&projectID); err != nil {
+			log.Fatalln("Unable to read projects", err.Error())
+		}
+		projectIDs = append(projectIDs, projectID)
+	}
+	rows.Close()
+
+	owners := map[string][]int{}
+	for _, projectID := range projectIDs {
+		projectWidgets, err := getProjectWidgets(db, projectID)
+		if err != nil {
+			log.Println("Unable to assign data logs to project", projectID, err)
+			continue
+		}
+
+		subscriptions := getProjectSubscriptions(projectWidgets)
+		for _, topic := range topics {
+			for filter := range subscriptions {
+				if topicMatches(filter, topic) {
+					owners[topic] = append(owners[topic], projectID)
+					break
+				}
+			}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalln("Unable to assign data logs to projects", err.Error())
+	}
+	defer tx.Rollback()
+
+	for topic, projectIDs := range owners {
+		for _, projectID := range projectIDs[1:] {
+			_, err = tx.Exec(`INSERT INTO data_logs(project_id, topic, data, properties, created_at)
+				SELECT ?, topic, data, properties, created_at FROM data_logs
+				WHERE project_id = 0 AND topic = ? ORDER BY id`, projectID, topic)
+			if err != nil {
+				log.Fatalln("Unable to assign data logs to projects", err.Error())
+			}
+		}
+
+		_, err = tx.Exec("UPDATE data_logs SET project_id = ? WHERE project_id = 0 AND topic = ?", projectIDs[0], topic)
+		if err != nil {
+			log.Fatalln("Unable to assign data logs to projects", err.Error())
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Fatalln("Unable to assign data logs to projects", err.Error())
 	}
 }
 
-func getTopicDataLogs(db *sql.DB, topic string, maxLength int) ([]DataLog, error) {
-	var logs []DataLog
+func createDataLog(db *sql.DB, projectID int, topic string, data []byte, properties *MessageProperties) error {
+	var encodedProperties []byte
+	if properties != nil {
+		var err error
+		encodedProperties, err = json.Marshal(properties)
+		if err != nil {
+			return err
+		}
+	}
 
-	rows, err := db.Query("SELECT * FROM data_logs where topic = ? ORDER BY id DESC LIMIT ?", topic, maxLength)
+	_, err := db.Exec("INSERT INTO data_logs(project_id, topic, data, properties, created_at) VALUES(?,?,?,?,?)", projectID, topic, data, string(encodedProperties), time.Now())
+	return err
+}
+
+// Calls visit with the data logs of the topic in the project, or of all
+// topics matching the filter, newest first until visit returns false.
+func scanDataLogs(db *sql.DB, projectID int, filter string, visit func(DataLog) bool) error {
+	query := "SELECT id, project_id, topic, data, properties, created_at FROM data_logs WHERE project_id = ? AND topic = ? ORDER BY id DESC"
+	argument := filter
+	if isTopicFilter(filter) {
+		// narrow the scan down to the literal prefix, wildcards are matched below
+		query = "SELECT id, project_id, topic, data, properties, created_at FROM data_logs WHERE project_id = ? AND topic LIKE ? ESCAPE '\\' ORDER BY id DESC"
+		argument = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(topicFilterPrefix(filter)) + "%"
+	}
+
+	rows, err := db.Query(query, projectID, argument)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var logRow DataLog
-		err = rows.Scan(&logRow.ID, &logRow.Topic, &logRow.Data, &logRow.CreatedAt)
+		err = rows.Scan(&logRow.ID, &logRow.ProjectID, &logRow.Topic, &logRow.Data, &logRow.Properties, &logRow.CreatedAt)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		logs = append(logs, logRow)
+		if !topicMatches(filter, logRow.Topic) {
+			continue
+		}
+		if !visit(logRow) {
+			break
+		}
 	}
 
-	rows.Close()
-
-	return logs, nil
+	return rows.Err()
 }
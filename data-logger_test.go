@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAssignDataLogsToProjects(t *testing.T) {
+	db := newTestDB(t)
+	createDataLogsTable(db)
+
+	// both projects show home/t, only the second one shows home/h
+	widgets := []struct {
+		projectID int
+		topic string
+	}{
+		{1, "home/t"},
+		{2, "home/+"},
+	}
+	for i, widget := range widgets {
+		_, err := db.Exec("INSERT INTO project_sections(id, project_id, name) VALUES (?, ?, 'Main')", i+1, widget.projectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO project_widgets(project_section_id, title, widget, config) VALUES (?, 'Value', 'TEXT', ?)", i+1, `{"Topic":"`+widget.topic+`"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, slug := range []string{"one", "two"} {
+		_, err := db.Exec("INSERT INTO projects(team_id, name, slug, broker_client_id, broker_address, broker_port, broker_protocol) VALUES (1, ?, ?, 'studio', 'localhost', 1883, 'tcp')", slug, slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// data logs recorded before they were kept per project
+	for _, row := range [][2]string{{"home/t", "20"}, {"home/h", "40"}, {"home/t", "21"}, {"office/t", "18"}} {
+		_, err := db.Exec("INSERT INTO data_logs(topic, data, created_at) VALUES (?, ?, ?)", row[0], row[1], time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrateDataLogsTable(db)
+
+	tests := []struct {
+		projectID int
+		filter string
+		want []string
+	}{
+		{1, "home/t", []string{"21", "20"}},
+		{1, "home/h", []string{}},
+		{2, "home/t", []string{"21", "20"}},
+		{2, "home/h", []string{"40"}},
+		{0, "office/t", []string{"18"}},
+	}
+
+	for _, test := range tests {
+		got := []string{}
+		err := scanDataLogs(db, test.projectID, test.filter, func(dataLog DataLog) bool {
+			got = append(got, string(dataLog.Data))
+			return true
+		})
+		if err != nil {
+			t.Errorf("%d %q: %v", test.projectID, test.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d %q: got %v, want %v", test.projectID, test.filter, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	DefaultDiscoveryPrefix string = "homeassistant"
+)
+
+// Components of Home Assistant MQTT discovery the import turns into widgets.
+var discoveryComponents = []string{"sensor", "binary_sensor", "switch", "light", "number"}
+
+// Abbreviated discovery keys and their full names.
+var discoveryAbbreviations = map[string]string{
+	"stat_t": "state_topic",
+	"cmd_t": "command_topic",
+	"val_tpl": "value_template",
+	"stat_val_tpl": "state_value_template",
+	"pl_on": "payload_on",
+	"pl_off": "payload_off",
+	"stat_on": "state_on",
+	"stat_off": "state_off",
+	"unit_of_meas": "unit_of_measurement",
+	"uniq_id": "unique_id",
+	"dev": "device",
+	"ret": "retain",
+	"cmd_tpl": "command_template",
+}
+
+// DiscoveredEntity is an entity announced on a discovery config topic.
+type DiscoveredEntity struct {
+	ConfigTopic string
+	Component string
+	ObjectID string
+	Name string
+	Device string
+	StateTopic string
+	CommandTopic string
+	ValueTemplate string
+	ValuePath string
+	PayloadOn string
+	PayloadOff string
+	StateOn string
+	StateOff string
+	Unit string
+	Min float64 // of number entities
+	Max float64
+	Step float64
+	PayloadTemplate string // of number entities, from the command template
+	Schema string
+	QoS byte
+	Retain bool
+	Widgets []string // types of the widgets the import creates
+	Warning string // why the entity is imported partly or not at all
+}
+
+type ProjectDiscoveryViewData struct {
+	Project *Project
+	Prefix string
+}
+
+type DiscoveryEntities struct {
+	Status string
+	Entities []DiscoveredEntity
+}
+
+// discoveryWidget is a widget the import creates for an entity, Topic is
+// subscribed unless the widget only publishes.
+type discoveryWidget struct {
+	Widget string
+	Title string
+	Config any
+	Topic string
+	QoS byte
+}
+
+var (
+	valueTemplatePattern = regexp.MustCompile(`^\{\{\s*value\s*(\|[^}]*)?\}\}$`)
+	valueJSONTemplatePattern = regexp.MustCompile(`^\{\{\s*value_json((?:\.\w+|\[[^\]]+\])+)\s*(\|[^}]*)?\}\}$`)
+)
+
+// Converts value templates selecting a JSON field, e.g. "{{ value_json.temp
+// | float }}", to a value path. Filters are dropped, other templates are not
+// supported.
+func valuePathFromTemplate(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if text == "" || valueTemplatePattern.MatchString(text) {
+		return "", true
+	}
+
+	match := valueJSONTemplatePattern.FindStringSubmatch(text)
+	if match == nil {
+		return "", false
+	}
+
+	path := strings.TrimPrefix(match[1], ".")
+	if _, err := parseValuePath(path); err != nil {
+		return "", false
+	}
+
+	return path, true
+}
+
+// Converts command templates that only place the value, e.g. "{"level":
+// {{ value }}}", to a slider payload template.
+func payloadTemplateFromCommand(text string) (string, bool) {
+	if strings.TrimSpace(text) == "" {
+		return DefaultSliderPayloadTemplate, true
+	}
+
+	template := sliderValuePattern.ReplaceAllLiteralString(text, DefaultSliderPayloadTemplate)
+	if strings.Count(template, "{{") != strings.Count(template, DefaultSliderPayloadTemplate) || strings.Contains(template, "{%") {
+		return "", false
+	}
+
+	return template, true
+}
+
+// Parses a discovery config, topic is the config topic. Entities of other
+// components are returned with a warning.
+func parseDiscoveryConfig(prefix string, topic string, payload []byte) (DiscoveredEntity, error) {
+	levels := strings.Split(strings.TrimPrefix(topic, prefix + "/"), "/")
+	entity := DiscoveredEntity{
+		ConfigTopic: topic,
+		Component: levels[0],
+		ObjectID: levels[len(levels) - 2],
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return entity, fmt.Errorf("%s: invalid discovery config: %w", topic, err)
+	}
+
+	config := map[string]any{}
+	for key, value := range raw {
+		if full, found := discoveryAbbreviations[key]; found {
+			key = full
+		}
+		config[key] = value
+	}
+
+	text := func(key string, fallback string) string {
+		switch value := config[key].(type) {
+		case nil:
+			return fallback
+		case string:
+			return value
+		default:
+			return fmt.Sprint(value)
+		}
+	}
+
+	// "~" abbreviates the base topic at the start or end of topics
+	base := text("~", "")
+	expand := func(topic string) string {
+		if strings.HasPrefix(topic, "~") {
+			return base + topic[1:]
+		}
+		if strings.HasSuffix(topic, "~") {
+			return topic[:len(topic) - 1] + base
+		}
+		return topic
+	}
+
+	if device, ok := config["device"].(map[string]any); ok {
+		entity.Device, _ = device["name"].(string)
+	}
+
+	entity.Name = text("name", "")
+	if entity.Name == "" {
+		entity.Name = entity.Device
+	}
+	if entity.Name == "" {
+		entity.Name = entity.ObjectID
+	}
+
+	entity.StateTopic = expand(text("state_topic", ""))
+	entity.CommandTopic = expand(text("command_topic", ""))
+	entity.Unit = text("unit_of_measurement", "")
+	entity.Schema = text("schema", "default")
+	entity.PayloadOn = text("payload_on", "ON")
+	entity.PayloadOff = text("payload_off", "OFF")
+	entity.StateOn = text("state_on", entity.PayloadOn)
+	entity.StateOff = text("state_off", entity.PayloadOff)
+	entity.Retain, _ = config["retain"].(bool)
+	if qos, ok := config["qos"].(float64); ok && qos >= 0 && qos <= 2 {
+		entity.QoS = byte(qos)
+	}
+
+	entity.ValueTemplate = text("value_template", "")
+	if entity.Component == "switch" || entity.Component == "light" {
+		entity.ValueTemplate = text("state_value_template", entity.ValueTemplate)
+	}
+
+	if entity.Component == "number" {
+		number := func(key string, fallback float64) float64 {
+			if value, ok := config[key].(float64); ok {
+				return value
+			}
+			return fallback
+		}
+
+		entity.Min = number("min", 1)
+		entity.Max = number("max", 100)
+		entity.Step = number("step", 1)
+	}
+
+	if entity.Component == "light" && entity.Schema == "json" {
+		// JSON lights send and expect {"state": "ON"}
+		entity.ValuePath = "state"
+		entity.PayloadOn = `{"state": "ON"}`
+		entity.PayloadOff = `{"state": "OFF"}`
+		entity.StateOn = "ON"
+		entity.StateOff = "OFF"
+	} else if path, ok := valuePathFromTemplate(entity.ValueTemplate); ok {
+		entity.ValuePath = path
+	} else {
+		entity.Warning = "value template is not supported, the whole payload is shown"
+	}
+
+	if entity.Component == "number" {
+		if template, ok := payloadTemplateFromCommand(text("command_template", "")); ok {
+			entity.PayloadTemplate = template
+		} else {
+			entity.PayloadTemplate = DefaultSliderPayloadTemplate
+			entity.Warning = "command template is not supported, the value is published as is"
+		}
+	}
+
+	for _, widget := range entity.widgets() {
+		entity.Widgets = append(entity.Widgets, widget.Widget)
+	}
+	if !slices.Contains(discoveryComponents, entity.Component) {
+		entity.Warning = "component is not supported"
+	} else if len(entity.Widgets) == 0 {
+		entity.Warning = "no state or command topic"
+	}
+
+	return entity, nil
+}
+
+// Returns the widgets that show and control the entity.
+func (e DiscoveredEntity) widgets() []discoveryWidget {
+	var widgets []discoveryWidget
+
+	title := e.Name
+	if e.Unit != "" {
+		title += " (" + e.Unit + ")"
+	}
+
+	switch e.Component {
+	case "number":
+		if e.CommandTopic != "" && e.Max > e.Min && e.Step > 0 {
+			widgets = append(widgets, discoveryWidget{
+				Widget: "SLIDER",
+				Title: e.Name,
+				Config: SliderWidgetConfig{
+					Topic: e.CommandTopic,
+					QoS: e.QoS,
+					Retain: e.Retain,
+					Min: e.Min,
+					Max: e.Max,
+					Step: e.Step,
+					Unit: e.Unit,
+					PayloadTemplate: e.PayloadTemplate,
+					StateTopic: e.StateTopic,
+					ValuePath: e.ValuePath,
+					Debounce: DefaultSliderDebounce,
+				},
+				Topic: e.StateTopic,
+				QoS: e.QoS,
+			})
+			break
+		}
+		fallthrough
+	case "sensor":
+		if e.StateTopic != "" {
+			widgets = append(widgets, discoveryWidget{
+				Widget: "TEXT",
+				Title: title,
+				Config: TextWidgetConfig{
+					Topic: e.StateTopic,
+					QoS: e.QoS,
+					ValuePath: e.ValuePath,
+				},
+				Topic: e.StateTopic,
+				QoS: e.QoS,
+			})
+		}
+	case "switch", "light":
+		if e.CommandTopic != "" {
+			widgets = append(widgets, discoveryWidget{
+				Widget: "SWITCH",
+				Title: e.Name,
+				Config: SwitchWidgetConfig{
+					Topic: e.CommandTopic,
+					QoS: e.QoS,
+					Retain: e.Retain,
+					PayloadOn: e.PayloadOn,
+					PayloadOff: e.PayloadOff,
+					StateTopic: e.StateTopic,
+					ValuePath: e.ValuePath,
+					StateOn: e.StateOn,
+					StateOff: e.StateOff,
+					Timeout: DefaultSwitchTimeout,
+				},
+				Topic: e.StateTopic,
+				QoS: e.QoS,
+			})
+			break
+		}
+		fallthrough
+	case "binary_sensor":
+		if e.StateTopic != "" {
+			widgets = append(widgets, discoveryWidget{
+				Widget: "INDICATOR",
+				Title: title,
+				Config: IndicatorWidgetConfig{
+					Topic: e.StateTopic,
+					QoS: e.QoS,
+					ValuePath: e.ValuePath,
+					OnCondition: e.StateOn,
+					Color: "blue",
+				},
+				Topic: e.StateTopic,
+				QoS: e.QoS,
+			})
+		}
+	}
+
+	return widgets
+}
+
+// Returns the entities announced on the discovery topics of the prefix
+// since connecting, removed entities have an empty config.
+func getDiscoveredEntities(connection *Connection, prefix string) []DiscoveredEntity {
+	entities := []DiscoveredEntity{}
+	if connection == nil {
+		return entities
+	}
+
+	messages := connection.MatchingMessages(prefix + "/+/+/config")
+	messages = append(messages, connection.MatchingMessages(prefix + "/+/+/+/config")...)
+	for _, message := range messages {
+		if len(message.Payload) == 0 {
+			continue
+		}
+
+		entity, err := parseDiscoveryConfig(prefix, message.Topic, message.Payload)
+		if err != nil {
+			entity.Name = entity.ObjectID
+			entity.Warning = err.Error()
+		}
+		entities = append(entities, entity)
+	}
+
+	slices.SortFunc(entities, func(a, b DiscoveredEntity) int {
+		if order := strings.Compare(a.Device, b.Device); order != 0 {
+			return order
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return entities
+}
+
+// Subscribes the discovery topics of the prefix, node IDs are optional.
+func subscribeDiscovery(connections *ConnectionManager, projectID int, prefix string) error {
+	for _, filter := range []string{prefix + "/+/+/config", prefix + "/+/+/+/config"} {
+		if err := connections.Subscribe(projectID, filter, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reads the discovery prefix query parameter, it must be a plain topic.
+func discoveryPrefix(r *http.Request) (string, error) {
+	prefix := strings.Trim(r.FormValue("prefix"), "/")
+	if prefix == "" {
+		prefix = DefaultDiscoveryPrefix
+	}
+
+	return prefix, validatePublishTopic(prefix)
+}
+
+func projectDiscoveryHandler(db *sql.DB, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		prefix, err := discoveryPrefix(r)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		tmpl := template.Must(template.ParseFiles("./views/layout.html", "./views/project-discovery.html"))
+		tmpl.Execute(w, ProjectDiscoveryViewData{
+			Project: project,
+			Prefix: prefix,
+		})
+	}
+}
+
+// Serves the discovered entities polled by the import page, the discovery
+// topics are subscribed on every request so retained configs arrive after
+// connecting.
+func projectDiscoveryEntitiesHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		prefix, err := discoveryPrefix(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := subscribeDiscovery(connections, project.ID, prefix); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		resp, err := json.Marshal(DiscoveryEntities{
+			Status: connections.StatusText(project.ID),
+			Entities: getDiscoveredEntities(connections.Get(project.ID), prefix),
+		})
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	}
+}
+
+// Creates a section with the widgets of the selected entities.
+func projectDiscoveryImportHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			fmt.Fprint(w, "Only POST method is supported.")
+			return
+		}
+
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		slug := r.PathValue("slug")
+		project, err := GetProjectBySlug(db, slug)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		prefix, err := discoveryPrefix(r)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		selected := r.Form["entity"]
+		if len(selected) == 0 {
+			fmt.Fprint(w, "ERROR: select at least one entity")
+			return
+		}
+
+		name := r.FormValue("section")
+		if name == "" {
+			name = "Home Assistant"
+		}
+
+		// the configs are read again, the page may show an older state
+		var widgets []discoveryWidget
+		for _, entity := range getDiscoveredEntities(connections.Get(project.ID), prefix) {
+			if slices.Contains(selected, entity.ConfigTopic) {
+				widgets = append(widgets, entity.widgets()...)
+			}
+		}
+		if len(widgets) == 0 {
+			fmt.Fprint(w, "ERROR: the selected entities have no widgets, are they still announced?")
+			return
+		}
+
+		res, err := db.Exec("INSERT INTO project_sections(project_id,name) VALUES(?,?)", project.ID, name)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+
+		sectionID, err := res.LastInsertId()
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+
+		stmt, err := db.Prepare("INSERT INTO project_widgets(project_section_id, widget, title, config) VALUES(?,?,?,?)")
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		defer stmt.Close()
+
+		for _, widget := range widgets {
+			config, err := json.Marshal(widget.Config)
+			if err != nil {
+				log.Fatal(err)
+				return
+			}
+
+			if _, err := stmt.Exec(sectionID, widget.Widget, widget.Title, config); err != nil {
+				log.Fatal(err)
+				return
+			}
+
+			if widget.Topic != "" {
+				if err := connections.Subscribe(project.ID, widget.Topic, widget.QoS); err != nil {
+					fmt.Fprintf(w, "ERROR: %v", err)
+					return
+				}
+			}
+		}
+
+		http.Redirect(w, r, "/projects/" + slug, http.StatusFound)
+	}
+}
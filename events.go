@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// Streams connection status, buffer usage and widget value changes of a
+// project as Server-Sent Events. Widgets are loaded once per stream and only
+// the widgets subscribed to an incoming topic are recalculated.
+func projectEventsHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		projectWidgets, err := getProjectWidgets(db, project.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		decoders, err := newPayloadDecoders(project)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		connection, events, cancel := connections.Listen(project.ID)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		widgets := newLiveWidgets(projectWidgets, decoders)
+
+		writeEvent(w, "status", connection.StatusText())
+		lastUsage := connection.BufferUsage()
+		writeEvent(w, "buffer", lastUsage)
+		flusher.Flush()
+
+		flushTicker := time.NewTicker(100 * time.Millisecond)
+		defer flushTicker.Stop()
+
+		usageTicker := time.NewTicker(2 * time.Second)
+		defer usageTicker.Stop()
+
+		pingTicker := time.NewTicker(15 * time.Second)
+		defer pingTicker.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-events:
+				if event.Type == EventStatus {
+					writeEvent(w, "status", event.Status)
+					flusher.Flush()
+					continue
+				}
+
+				if event.Type == EventRequest || event.Type == EventSwitch {
+					widgets.TouchWidget(event.WidgetID)
+					continue
+				}
+
+				widgets.Touch(event.Message.Topic)
+			case <-flushTicker.C:
+				if !widgets.Dirty() {
+					continue
+				}
+
+				data, err := widgets.Collect(db, connection)
+				if err != nil {
+					writeEvent(w, "error", err.Error())
+				}
+				writeEvent(w, "data", data)
+				flusher.Flush()
+			case <-usageTicker.C:
+				usage := connection.BufferUsage()
+				if usage != lastUsage {
+					writeEvent(w, "buffer", usage)
+					flusher.Flush()
+					lastUsage = usage
+				}
+			case <-pingTicker.C:
+				fmt.Fprint(w, ": ping\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// liveWidgets tracks which widgets of a stream have to be sent again, so
+// bursts of messages cause one update per widget.
+type liveWidgets struct {
+	widgets []ProjectWidget
+	decoders *PayloadDecoders
+	dirty map[int]bool
+	sentAt map[int]time.Time // charts, see ChartRefreshInterval
+}
+
+// All widgets start dirty so the first update carries every value.
+func newLiveWidgets(projectWidgets []ProjectWidget, decoders *PayloadDecoders) *liveWidgets {
+	dirty := map[int]bool{}
+	for _, projectWidget := range projectWidgets {
+		dirty[projectWidget.ID] = true
+	}
+
+	return &liveWidgets{
+		widgets: projectWidgets,
+		decoders: decoders,
+		dirty: dirty,
+		sentAt: map[int]time.Time{},
+	}
+}
+
+// Marks the widgets whose topic filters match the topic as changed.
+func (l *liveWidgets) Touch(topic string) {
+	for _, projectWidget := range l.widgets {
+		if widgetMatchesTopic(projectWidget, topic) {
+			l.dirty[projectWidget.ID] = true
+		}
+	}
+}
+
+func (l *liveWidgets) TouchWidget(id int) {
+	if _, found := l.Find(id); found {
+		l.dirty[id] = true
+	}
+}
+
+// Reports whether any widget subscribes to the topic.
+func (l *liveWidgets) Subscribed(topic string) bool {
+	for _, projectWidget := range l.widgets {
+		if widgetMatchesTopic(projectWidget, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *liveWidgets) Find(id int) (ProjectWidget, bool) {
+	for _, projectWidget := range l.widgets {
+		if projectWidget.ID == id {
+			return projectWidget, true
+		}
+	}
+
+	return ProjectWidget{}, false
+}
+
+// Reports whether a changed widget can be sent. Charts read the data logs,
+// they stay changed until ChartRefreshInterval passed since they were sent.
+func (l *liveWidgets) Dirty() bool {
+	for _, projectWidget := range l.widgets {
+		if l.dirty[projectWidget.ID] && l.ready(projectWidget) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *liveWidgets) ready(projectWidget ProjectWidget) bool {
+	if projectWidget.Widget != "TIMESERIES-LINE-CHART" {
+		return true
+	}
+
+	return time.Since(l.sentAt[projectWidget.ID]) >= ChartRefreshInterval
+}
+
+// Builds the data of the changed widgets that can be sent and resets them,
+// widgets that fail are skipped and the first error is returned.
+func (l *liveWidgets) Collect(db *sql.DB, connection *Connection) ([]WidgetData, error) {
+	var data []WidgetData
+	var firstErr error
+
+	for _, projectWidget := range l.widgets {
+		if !l.dirty[projectWidget.ID] || !l.ready(projectWidget) {
+			continue
+		}
+		delete(l.dirty, projectWidget.ID)
+		if projectWidget.Widget == "TIMESERIES-LINE-CHART" {
+			l.sentAt[projectWidget.ID] = time.Now()
+		}
+
+		widgetData, err := getWidgetData(db, connection, l.decoders, projectWidget)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		data = append(data, widgetData)
+	}
+
+	return data, firstErr
+}
+
+func writeEvent(w http.ResponseWriter, name string, data any) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, encoded)
+}
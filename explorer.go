@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+type ProjectExplorerViewData struct {
+	Project *Project
+	Sections []ProjectSection
+}
+
+type ExplorerTree struct {
+	Status string
+	Filter string
+	Topics []TopicTreeNode
+}
+
+func projectExplorerHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		sections, err := getProjectSections(db, project.ID)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		tmpl := template.Must(template.ParseFiles("./views/layout.html", "./views/project-explorer.html"))
+		tmpl.Execute(w, ProjectExplorerViewData{
+			Project: project,
+			Sections: sections,
+		})
+	}
+}
+
+// Serves the topic tree polled by the explorer page, the explorer filter is
+// subscribed on the first request after every connect.
+func projectExplorerTreeHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if err := connections.Explore(project.ID, project.ExplorerFilter); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		resp, err := json.Marshal(ExplorerTree{
+			Status: connections.StatusText(project.ID),
+			Filter: project.ExplorerFilter,
+			Topics: connections.TopicTree(project.ID),
+		})
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	}
+}
+
+func getProjectSections(db *sql.DB, projectID int) ([]ProjectSection, error) {
+	rows, err := db.Query("SELECT id, name FROM project_sections WHERE project_id = ?", projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sections []ProjectSection
+	for rows.Next() {
+		var section ProjectSection
+		if err := rows.Scan(&section.ID, &section.Name); err != nil {
+			return nil, err
+		}
+		section.ProjectID = projectID
+
+		sections = append(sections, section)
+	}
+
+	return sections, rows.Err()
+}
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxExpressionLength int = 1024
+	maxExpressionDepth int = 64
+)
+
+// Expression is a compiled widget expression, e.g. "round(value / 10, 1)" or
+// "value & 0x04 != 0". Expressions only see the widget value and its topic,
+// they cannot loop, call into Go or touch anything outside, so they are safe
+// to evaluate for every request.
+type Expression struct {
+	source string
+	root expressionNode
+	usesValue bool
+}
+
+type expressionVars struct {
+	value any
+	topic string
+}
+
+type expressionNode interface {
+	eval(vars *expressionVars) (any, error)
+}
+
+// Operators by precedence, as in Go. Higher binds tighter.
+var expressionPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4, "|": 4, "^": 4,
+	"*": 5, "/": 5, "%": 5, "<<": 5, ">>": 5, "&": 5,
+}
+
+// Compiles the expression, an empty text compiles to nil which leaves values
+// unchanged.
+func compileExpression(text string) (*Expression, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, nil
+	}
+	if len(text) > maxExpressionLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", maxExpressionLength)
+	}
+
+	tokens, err := tokenizeExpression(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", text, err)
+	}
+
+	parser := &expressionParser{
+		tokens: tokens,
+	}
+	root, err := parser.parseConditional()
+	if err == nil && parser.position < len(parser.tokens) {
+		err = fmt.Errorf("unexpected %q", parser.peek().text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", text, err)
+	}
+
+	return &Expression{
+		source: text,
+		root: root,
+		usesValue: parser.usesValue,
+	}, nil
+}
+
+// Evaluates the expression for the value text of a widget, numbers and
+// booleans in the text are converted first.
+func (e *Expression) Evaluate(topic string, value string) (any, error) {
+	result, err := e.root.eval(&expressionVars{
+		value: expressionValue(value),
+		topic: topic,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", e.source, err)
+	}
+
+	return result, nil
+}
+
+// Returns the transformed value text, a nil expression returns the value.
+func (e *Expression) Apply(topic string, value string) (string, error) {
+	if e == nil {
+		return value, nil
+	}
+
+	result, err := e.Evaluate(topic, value)
+	if err != nil {
+		return "", err
+	}
+
+	return formatExpressionValue(result), nil
+}
+
+// Reports whether an indicator is on. Conditions using the value must be
+// true or false, constant conditions such as 1 or "ON" are compared with the
+// value, and text that is no expression at all is compared as it is.
+func indicatorState(condition string, topic string, value string) (bool, error) {
+	expression, err := compileExpression(condition)
+	if err != nil || expression == nil {
+		return strings.TrimSpace(value) == strings.TrimSpace(condition), nil
+	}
+
+	result, err := expression.Evaluate(topic, value)
+	if err != nil {
+		return false, err
+	}
+
+	if !expression.usesValue {
+		return expressionEqual(result, expressionValue(value)), nil
+	}
+
+	state, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s: condition must be true or false, got %s", expression.source, formatExpressionValue(result))
+	}
+
+	return state, nil
+}
+
+// Converts value text the way expressions see it: numbers, booleans or text.
+func expressionValue(text string) any {
+	trimmed := strings.TrimSpace(text)
+	if number, err := strconv.ParseFloat(trimmed, 64); err == nil && !math.IsInf(number, 0) && !math.IsNaN(number) {
+		return number
+	}
+
+	switch trimmed {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	return text
+}
+
+func formatExpressionValue(value any) string {
+	switch value := value.(type) {
+	case float64:
+		// 15 significant digits hide float noise, e.g. 300 - 273.15
+		rounded, _ := strconv.ParseFloat(strconv.FormatFloat(value, 'g', 15, 64), 64)
+		return strconv.FormatFloat(rounded, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case string:
+		return value
+	}
+
+	return "null"
+}
+
+func expressionEqual(a any, b any) bool {
+	return a == b
+}
+
+func expressionTypeName(value any) string {
+	switch value.(type) {
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case string:
+		return "text"
+	}
+
+	return "null"
+}
+
+type expressionToken struct {
+	kind byte // 'n' number, 's' string, 'i' identifier, 'o' operator or punctuation
+	text string
+	number float64
+}
+
+func tokenizeExpression(text string) ([]expressionToken, error) {
+	var tokens []expressionToken
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i + 1 < len(text) && text[i + 1] >= '0' && text[i + 1] <= '9':
+			start := i
+			prefix := strings.ToLower(text[start:min(start + 2, len(text))])
+			integer := prefix == "0x" || prefix == "0b"
+			for i < len(text) {
+				if isExpressionWordByte(text[i]) || text[i] == '.' {
+					i++
+					continue
+				}
+				// exponent sign, e.g. 1e-3
+				if (text[i] == '+' || text[i] == '-') && (text[i - 1] == 'e' || text[i - 1] == 'E') && !integer {
+					i++
+					continue
+				}
+				break
+			}
+			literal := text[start:i]
+			var number float64
+			if integer {
+				whole, err := strconv.ParseInt(literal, 0, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid number %q", literal)
+				}
+				number = float64(whole)
+			} else {
+				var err error
+				number, err = strconv.ParseFloat(literal, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid number %q", literal)
+				}
+			}
+			tokens = append(tokens, expressionToken{kind: 'n', text: literal, number: number})
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(text) && text[end] != c {
+				if text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(text) {
+				return nil, errors.New("unterminated string")
+			}
+			literal := text[i:end + 1]
+			if c == '\'' {
+				// single quoted strings follow the same escapes
+				literal = `"` + strings.ReplaceAll(literal[1:len(literal) - 1], `"`, `\"`) + `"`
+			}
+			value, err := strconv.Unquote(literal)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s", text[i:end + 1])
+			}
+			tokens = append(tokens, expressionToken{kind: 's', text: value})
+			i = end + 1
+		case isExpressionWordByte(c):
+			start := i
+			for i < len(text) && isExpressionWordByte(text[i]) {
+				i++
+			}
+			tokens = append(tokens, expressionToken{kind: 'i', text: text[start:i]})
+		default:
+			operator := ""
+			for _, candidate := range []string{"||", "&&", "==", "!=", "<=", ">=", "<<", ">>", "<", ">", "+", "-", "*", "/", "%", "&", "|", "^", "!", "~", "(", ")", ",", "?", ":"} {
+				if strings.HasPrefix(text[i:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected character %q", rune(c))
+			}
+			tokens = append(tokens, expressionToken{kind: 'o', text: operator})
+			i += len(operator)
+		}
+	}
+
+	return tokens, nil
+}
+
+func isExpressionWordByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+type expressionParser struct {
+	tokens []expressionToken
+	position int
+	depth int
+	usesValue bool
+}
+
+func (p *expressionParser) peek() expressionToken {
+	if p.position < len(p.tokens) {
+		return p.tokens[p.position]
+	}
+
+	return expressionToken{}
+}
+
+// Reports whether the next token is the operator or punctuation.
+func (p *expressionParser) peekOperator(text string) bool {
+	token := p.peek()
+	return token.kind == 'o' && token.text == text
+}
+
+func (p *expressionParser) next() expressionToken {
+	token := p.peek()
+	p.position++
+	return token
+}
+
+func (p *expressionParser) expect(text string) error {
+	if token := p.next(); token.kind != 'o' || token.text != text {
+		if token.text == "" {
+			return fmt.Errorf("expected %q at the end", text)
+		}
+		return fmt.Errorf("expected %q, got %q", text, token.text)
+	}
+
+	return nil
+}
+
+// conditional = binary [ "?" conditional ":" conditional ]
+func (p *expressionParser) parseConditional() (expressionNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxExpressionDepth {
+		return nil, errors.New("expression is nested too deeply")
+	}
+
+	condition, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.peekOperator("?") {
+		return condition, nil
+	}
+	p.next()
+
+	then, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+
+	return conditionalNode{condition, then, otherwise}, nil
+}
+
+// Parses operators binding at least as tight as precedence.
+func (p *expressionParser) parseBinary(precedence int) (expressionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token := p.peek()
+		operatorPrecedence, found := expressionPrecedence[token.text]
+		if token.kind != 'o' || !found || operatorPrecedence < precedence {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseBinary(operatorPrecedence + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{token.text, left, right}
+	}
+}
+
+func (p *expressionParser) parseUnary() (expressionNode, error) {
+	token := p.peek()
+	if token.kind == 'o' && (token.text == "-" || token.text == "!" || token.text == "~" || token.text == "+") {
+		p.next()
+
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > maxExpressionDepth {
+			return nil, errors.New("expression is nested too deeply")
+		}
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{token.text, operand}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *expressionParser) parsePrimary() (expressionNode, error) {
+	token := p.next()
+
+	switch token.kind {
+	case 'n':
+		return literalNode{token.number}, nil
+	case 's':
+		return literalNode{token.text}, nil
+	case 'i':
+		switch token.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		case "value":
+			p.usesValue = true
+			return variableNode{token.text}, nil
+		case "topic":
+			return variableNode{token.text}, nil
+		}
+
+		function, found := expressionFunctions[token.text]
+		if !found {
+			return nil, fmt.Errorf("unknown name %q, use value, topic or a function", token.text)
+		}
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+
+		var args []expressionNode
+		for !p.peekOperator(")") {
+			arg, err := p.parseConditional()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if !p.peekOperator(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+
+		if len(args) < function.minArgs || function.maxArgs >= 0 && len(args) > function.maxArgs {
+			return nil, fmt.Errorf("wrong number of arguments for %s", token.text)
+		}
+
+		return callNode{token.text, function, args}, nil
+	case 'o':
+		if token.text == "(" {
+			node, err := p.parseConditional()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		}
+		return nil, fmt.Errorf("unexpected %q", token.text)
+	}
+
+	return nil, errors.New("unexpected end")
+}
+
+type literalNode struct {
+	value any
+}
+
+func (n literalNode) eval(vars *expressionVars) (any, error) {
+	return n.value, nil
+}
+
+type variableNode struct {
+	name string
+}
+
+func (n variableNode) eval(vars *expressionVars) (any, error) {
+	if n.name == "topic" {
+		return vars.topic, nil
+	}
+
+	return vars.value, nil
+}
+
+type unaryNode struct {
+	operator string
+	operand expressionNode
+}
+
+func (n unaryNode) eval(vars *expressionVars) (any, error) {
+	operand, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.operator {
+	case "!":
+		value, ok := operand.(bool)
+		if !ok {
+			return nil, fmt.Errorf("! needs a boolean, got %s", expressionTypeName(operand))
+		}
+		return !value, nil
+	case "~":
+		value, err := expressionInteger("~", operand)
+		if err != nil {
+			return nil, err
+		}
+		return float64(^value), nil
+	}
+
+	value, ok := operand.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s needs a number, got %s", n.operator, expressionTypeName(operand))
+	}
+	if n.operator == "-" {
+		return -value, nil
+	}
+
+	return value, nil
+}
+
+type binaryNode struct {
+	operator string
+	left expressionNode
+	right expressionNode
+}
+
+func (n binaryNode) eval(vars *expressionVars) (any, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || skip the right side when the left decides
+	if n.operator == "&&" || n.operator == "||" {
+		value, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %s", n.operator, expressionTypeName(left))
+		}
+		if value == (n.operator == "||") {
+			return value, nil
+		}
+		right, err := n.right.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := right.(bool); !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %s", n.operator, expressionTypeName(right))
+		}
+		return right, nil
+	}
+
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.operator {
+	case "==":
+		return expressionEqual(left, right), nil
+	case "!=":
+		return !expressionEqual(left, right), nil
+	case "+":
+		// text joins anything
+		leftText, leftIsText := left.(string)
+		rightText, rightIsText := right.(string)
+		if leftIsText || rightIsText {
+			if !leftIsText {
+				leftText = formatExpressionValue(left)
+			}
+			if !rightIsText {
+				rightText = formatExpressionValue(right)
+			}
+			return leftText + rightText, nil
+		}
+	case "<", "<=", ">", ">=":
+		if leftText, ok := left.(string); ok {
+			rightText, ok := right.(string)
+			if !ok {
+				return nil, fmt.Errorf("cannot compare text with %s", expressionTypeName(right))
+			}
+			order := strings.Compare(leftText, rightText)
+			return compareOrder(n.operator, float64(order), 0), nil
+		}
+	case "&", "|", "^", "<<", ">>":
+		a, err := expressionInteger(n.operator, left)
+		if err != nil {
+			return nil, err
+		}
+		b, err := expressionInteger(n.operator, right)
+		if err != nil {
+			return nil, err
+		}
+		switch n.operator {
+		case "&":
+			return float64(a & b), nil
+		case "|":
+			return float64(a | b), nil
+		case "^":
+			return float64(a ^ b), nil
+		}
+		if b < 0 || b > 63 {
+			return nil, fmt.Errorf("shift count %d is out of range", b)
+		}
+		if n.operator == "<<" {
+			return float64(a << b), nil
+		}
+		return float64(a >> b), nil
+	}
+
+	a, leftOK := left.(float64)
+	b, rightOK := right.(float64)
+	if !leftOK || !rightOK {
+		return nil, fmt.Errorf("%s needs numbers, got %s and %s", n.operator, expressionTypeName(left), expressionTypeName(right))
+	}
+
+	switch n.operator {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return a / b, nil
+	case "%":
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return math.Mod(a, b), nil
+	}
+
+	return compareOrder(n.operator, a, b), nil
+}
+
+func compareOrder(operator string, a float64, b float64) bool {
+	switch operator {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	}
+
+	return a >= b
+}
+
+// Bit operations need whole numbers.
+func expressionInteger(operator string, value any) (int64, error) {
+	number, ok := value.(float64)
+	if !ok || number != math.Trunc(number) || math.Abs(number) > 1 << 53 {
+		return 0, fmt.Errorf("%s needs whole numbers, got %s", operator, formatExpressionValue(value))
+	}
+
+	return int64(number), nil
+}
+
+type conditionalNode struct {
+	condition expressionNode
+	then expressionNode
+	otherwise expressionNode
+}
+
+func (n conditionalNode) eval(vars *expressionVars) (any, error) {
+	condition, err := n.condition.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := condition.(bool)
+	if !ok {
+		return nil, fmt.Errorf("? needs a boolean, got %s", expressionTypeName(condition))
+	}
+	if value {
+		return n.then.eval(vars)
+	}
+
+	return n.otherwise.eval(vars)
+}
+
+type expressionFunction struct {
+	minArgs int
+	maxArgs int // -1 for any number
+	call func(args []any) (any, error)
+}
+
+type callNode struct {
+	name string
+	function expressionFunction
+	args []expressionNode
+}
+
+func (n callNode) eval(vars *expressionVars) (any, error) {
+	args := make([]any, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+
+	result, err := n.function.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.name, err)
+	}
+
+	return result, nil
+}
+
+func expressionNumbers(args []any) ([]float64, error) {
+	numbers := make([]float64, len(args))
+	for i, arg := range args {
+		number, ok := arg.(float64)
+		if !ok {
+			return nil, fmt.Errorf("needs numbers, got %s", expressionTypeName(arg))
+		}
+		numbers[i] = number
+	}
+
+	return numbers, nil
+}
+
+func numberFunction(call func(x []float64) float64) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		numbers, err := expressionNumbers(args)
+		if err != nil {
+			return nil, err
+		}
+		return call(numbers), nil
+	}
+}
+
+func textFunction(call func(text string) any) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		text, ok := args[0].(string)
+		if !ok {
+			text = formatExpressionValue(args[0])
+		}
+		return call(text), nil
+	}
+}
+
+// Functions available to expressions.
+var expressionFunctions = map[string]expressionFunction{
+	"round": {1, 2, numberFunction(func(x []float64) float64 {
+		scale := 1.0
+		if len(x) == 2 {
+			scale = math.Pow(10, math.Trunc(x[1]))
+		}
+		return math.Round(x[0] * scale) / scale
+	})},
+	"floor": {1, 1, numberFunction(func(x []float64) float64 { return math.Floor(x[0]) })},
+	"ceil": {1, 1, numberFunction(func(x []float64) float64 { return math.Ceil(x[0]) })},
+	"int": {1, 1, numberFunction(func(x []float64) float64 { return math.Trunc(x[0]) })},
+	"abs": {1, 1, numberFunction(func(x []float64) float64 { return math.Abs(x[0]) })},
+	"sqrt": {1, 1, numberFunction(func(x []float64) float64 { return math.Sqrt(x[0]) })},
+	"pow": {2, 2, numberFunction(func(x []float64) float64 { return math.Pow(x[0], x[1]) })},
+	"min": {1, -1, numberFunction(func(x []float64) float64 {
+		result := x[0]
+		for _, value := range x[1:] {
+			result = math.Min(result, value)
+		}
+		return result
+	})},
+	"max": {1, -1, numberFunction(func(x []float64) float64 {
+		result := x[0]
+		for _, value := range x[1:] {
+			result = math.Max(result, value)
+		}
+		return result
+	})},
+	"clamp": {3, 3, numberFunction(func(x []float64) float64 { return math.Max(x[1], math.Min(x[2], x[0])) })},
+	"bit": {2, 2, func(args []any) (any, error) {
+		value, err := expressionInteger("bit", args[0])
+		if err != nil {
+			return nil, err
+		}
+		bit, err := expressionInteger("bit", args[1])
+		if err != nil || bit < 0 || bit > 63 {
+			return nil, fmt.Errorf("bit %s is out of range", formatExpressionValue(args[1]))
+		}
+		return value & (1 << bit) != 0, nil
+	}},
+	"num": {1, 1, func(args []any) (any, error) {
+		if number, ok := args[0].(float64); ok {
+			return number, nil
+		}
+		number, ok := expressionValue(formatExpressionValue(args[0])).(float64)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a number", formatExpressionValue(args[0]))
+		}
+		return number, nil
+	}},
+	"str": {1, 1, textFunction(func(text string) any { return text })},
+	"len": {1, 1, textFunction(func(text string) any { return float64(len([]rune(text))) })},
+	"lower": {1, 1, textFunction(func(text string) any { return strings.ToLower(text) })},
+	"upper": {1, 1, textFunction(func(text string) any { return strings.ToUpper(text) })},
+	"contains": {2, 2, func(args []any) (any, error) {
+		return strings.Contains(formatExpressionValue(args[0]), formatExpressionValue(args[1])), nil
+	}},
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpressionApply(t *testing.T) {
+	tests := []struct {
+		expression string
+		value string
+		want string
+	}{
+		// precedence follows Go
+		{"value & 0x04 != 0", "6", "true"},
+		{"value & 0x04 != 0", "3", "false"},
+		{"2 + 3 * 4", "", "14"},
+		{"(2 + 3) * 4", "", "20"},
+		{"1 << 2 + 1", "", "5"},
+		{"10 - 4 - 3", "", "3"},
+		{"-2 * 3", "", "-6"},
+		{"-value + 1", "5", "-4"},
+		{"- -value", "5", "5"},
+		{"~0b101 & 7", "", "2"},
+		{"!true || true", "", "true"},
+		{"1 < 2 && 2 < 3", "", "true"},
+		{"value > 20 ? 'hot' : 'cold'", "25", "hot"},
+		{"value > 20 ? 'hot' : value > 10 ? 'warm' : 'cold'", "15", "warm"},
+
+		// && and || skip the right side once the left decides
+		{"false && 1 / 0 > 0", "", "false"},
+		{"true || 1 / 0 > 0", "", "true"},
+
+		// values are numbers, booleans or text
+		{"value == 20", "20.0", "true"},
+		{"value == '20'", "20", "false"},
+		{"value == 'on'", "on", "true"},
+		{"value && true", "true", "true"},
+		{"'abc' < 'abd'", "", "true"},
+		{"value + 1", "a", "a1"},
+		{"'n=' + value", "2.50", "n=2.5"},
+		{"topic", "", "home/t"},
+		{"300 - 273.15", "", "26.85"},
+		{"value * 0.1", "1e2", "10"},
+		{"null", "", "null"},
+
+		// functions
+		{"round(value)", "2.5", "3"},
+		{"round(value, 2)", "2.346", "2.35"},
+		{"round(value / 10, 1)", "234", "23.4"},
+		{"floor(-1.5)", "", "-2"},
+		{"ceil(1.2)", "", "2"},
+		{"int(-1.7)", "", "-1"},
+		{"abs(-3)", "", "3"},
+		{"sqrt(16)", "", "4"},
+		{"pow(2, 10)", "", "1024"},
+		{"min(3, 1, 2)", "", "1"},
+		{"max(3, 1, 2)", "", "3"},
+		{"min(value)", "7", "7"},
+		{"clamp(value, 0, 10)", "15", "10"},
+		{"clamp(value, 0, 10)", "-5", "0"},
+		{"bit(value, 2)", "5", "true"},
+		{"bit(value, 1)", "5", "false"},
+		{"num('12') + 1", "", "13"},
+		{"str(1.5) + 'x'", "", "1.5x"},
+		{"len(value)", "héllo", "5"},
+		{"lower('AB')", "", "ab"},
+		{"upper(value)", "ab", "AB"},
+		{"contains(value, 'ell')", "hello", "true"},
+	}
+
+	for _, test := range tests {
+		expression, err := compileExpression(test.expression)
+		if err != nil {
+			t.Errorf("%s: %v", test.expression, err)
+			continue
+		}
+
+		got, err := expression.Apply("home/t", test.value)
+		if err != nil {
+			t.Errorf("%s with %q: %v", test.expression, test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s with %q = %q, want %q", test.expression, test.value, got, test.want)
+		}
+	}
+}
+
+func TestExpressionEvaluateErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		value string
+		err string
+	}{
+		{"1 / value", "0", "division by zero"},
+		{"value % 0", "5", "division by zero"},
+		{"true && 1 / 0 > 0", "", "division by zero"},
+		{"value < 5", "abc", "cannot compare text"},
+		{"value - 1", "abc", "needs numbers"},
+		{"!value", "1", "needs a boolean"},
+		{"value && true", "1", "needs booleans"},
+		{"value ? 1 : 2", "1", "needs a boolean"},
+		{"~value", "1.5", "needs whole numbers"},
+		{"1 << 64", "", "out of range"},
+		{"min('a')", "", "needs numbers"},
+		{"bit(1, 64)", "", "out of range"},
+		{"num(value)", "abc", "is not a number"},
+	}
+
+	for _, test := range tests {
+		expression, err := compileExpression(test.expression)
+		if err != nil {
+			t.Errorf("%s: %v", test.expression, err)
+			continue
+		}
+
+		_, err = expression.Apply("home/t", test.value)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s with %q: got error %v, want %q", test.expression, test.value, err, test.err)
+		}
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		err string
+	}{
+		{"1 +", "unexpected end"},
+		{"1 2", "unexpected"},
+		{"(1", "expected \")\""},
+		{"value ? 1", "expected \":\""},
+		{"foo(1)", "unknown name"},
+		{"round()", "wrong number of arguments"},
+		{"pow(1, 2, 3)", "wrong number of arguments"},
+		{"'abc", "unterminated string"},
+		{"0xZZ", "invalid number"},
+		{"value # 1", "unexpected character"},
+		{strings.Repeat("(", 100) + "1" + strings.Repeat(")", 100), "nested too deeply"},
+		{strings.Repeat("-", 100) + "1", "nested too deeply"},
+		{strings.Repeat("1 ? ", 100) + "1" + strings.Repeat(" : 1", 100), "nested too deeply"},
+		{strings.Repeat("1+", 600) + "1", "longer than"},
+	}
+
+	for _, test := range tests {
+		_, err := compileExpression(test.expression)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%.40s: got error %v, want %q", test.expression, err, test.err)
+		}
+	}
+}
+
+func TestEmptyExpressionKeepsValue(t *testing.T) {
+	expression, err := compileExpression("  ")
+	if err != nil || expression != nil {
+		t.Fatalf("got %v, %v, want nil expression", expression, err)
+	}
+
+	got, err := expression.Apply("home/t", "21.5")
+	if err != nil || got != "21.5" {
+		t.Errorf("got %q, %v, want the value unchanged", got, err)
+	}
+}
+
+func TestIndicatorState(t *testing.T) {
+	tests := []struct {
+		condition string
+		value string
+		want bool
+	}{
+		// conditions using the value
+		{"value > 20", "25", true},
+		{"value > 20", "15", false},
+		{"value & 0x04 != 0", "4", true},
+		{"contains(value, 'open')", "door open", true},
+
+		// constants are compared with the value
+		{"1", "1.0", true},
+		{"1", "0", false},
+		{"true", "true", true},
+		{"'ON'", "ON", true},
+
+		// text that is no expression is compared as it is
+		{"ON", "ON", true},
+		{"ON", "OFF", false},
+		{"ON", " ON ", true},
+		{"open door", "open door", true},
+		{"#ff0000", "#ff0000", true},
+		{"{\"state\": 1}", "{\"state\": 1}", true},
+	}
+
+	for _, test := range tests {
+		got, err := indicatorState(test.condition, "home/t", test.value)
+		if err != nil {
+			t.Errorf("%s with %q: %v", test.condition, test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s with %q = %v, want %v", test.condition, test.value, got, test.want)
+		}
+	}
+}
+
+func TestIndicatorStateNeedsBoolean(t *testing.T) {
+	if _, err := indicatorState("value + 1", "home/t", "1"); err == nil {
+		t.Error("got no error for a condition that is not true or false")
+	}
+}
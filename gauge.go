@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	GaugeRadial string = "RADIAL"
+	GaugeLinear string = "LINEAR"
+	maxGaugePrecision int = 6
+)
+
+// CSS color names and hex colors, the colors end up in style attributes.
+var colorPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+// GaugeThreshold starts a colored band at From, the band ends at the next
+// threshold or at the maximum of the gauge.
+type GaugeThreshold struct {
+	From float64
+	Color string
+}
+
+// Positions of the bands are fractions of the gauge scale.
+type GaugeBand struct {
+	From float64
+	To float64
+	Color string
+}
+
+type GaugeWidgetData struct {
+	Value float64
+	Text string // formatted with the precision of the gauge
+	Position float64 // of the value on the scale, from 0 to 1
+	Color string // of the band the value is in
+	Bands []GaugeBand
+	ReceivedAt time.Time
+	StaleAfter int
+	Stale bool
+}
+
+// Reads the gauge specific fields of the widget forms.
+func parseGaugeForm(r *http.Request) (GaugeWidgetConfig, error) {
+	config := GaugeWidgetConfig{
+		Variant: r.FormValue("variant"),
+		Unit: strings.TrimSpace(r.FormValue("unit")),
+	}
+
+	if config.Variant == "" {
+		config.Variant = GaugeRadial
+	}
+	if config.Variant != GaugeRadial && config.Variant != GaugeLinear {
+		return config, fmt.Errorf("invalid gauge variant %q", config.Variant)
+	}
+
+	var err error
+	config.Min, err = parseNumberField(r.FormValue("min"), 0)
+	if err != nil {
+		return config, fmt.Errorf("invalid minimum: %w", err)
+	}
+	config.Max, err = parseNumberField(r.FormValue("max"), 100)
+	if err != nil {
+		return config, fmt.Errorf("invalid maximum: %w", err)
+	}
+	if config.Max <= config.Min {
+		return config, fmt.Errorf("maximum must be greater than the minimum")
+	}
+
+	precision, err := parseNumberField(r.FormValue("precision"), 1)
+	if err != nil || precision != math.Trunc(precision) || precision < 0 || precision > float64(maxGaugePrecision) {
+		return config, fmt.Errorf("precision must be a whole number from 0 to %d", maxGaugePrecision)
+	}
+	config.Precision = int(precision)
+
+	staleAfter, err := parseNumberField(r.FormValue("stale-after"), 0)
+	if err != nil || staleAfter != math.Trunc(staleAfter) || staleAfter < 0 {
+		return config, fmt.Errorf("stale interval must be a whole number of seconds")
+	}
+	config.StaleAfter = int(staleAfter)
+
+	config.Thresholds, err = parseGaugeThresholds(r.FormValue("thresholds"))
+	if err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// Parses comma separated "value:color" pairs, e.g. "0:green, 60:orange,
+// 80:red", into thresholds sorted by value.
+func parseGaugeThresholds(text string) ([]GaugeThreshold, error) {
+	var thresholds []GaugeThreshold
+	for _, part := range strings.Split(text, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		from, color, found := strings.Cut(part, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid threshold %q, expected value:color", part)
+		}
+
+		value, err := parseNumberField(from, 0)
+		if err != nil || strings.TrimSpace(from) == "" {
+			return nil, fmt.Errorf("invalid threshold %q, expected value:color", part)
+		}
+
+		color = strings.TrimSpace(color)
+		if !colorPattern.MatchString(color) {
+			return nil, fmt.Errorf("invalid threshold color %q", color)
+		}
+
+		thresholds = append(thresholds, GaugeThreshold{
+			From: value,
+			Color: color,
+		})
+	}
+
+	slices.SortStableFunc(thresholds, func(a, b GaugeThreshold) int {
+		if a.From < b.From {
+			return -1
+		}
+		if a.From > b.From {
+			return 1
+		}
+		return 0
+	})
+
+	return thresholds, nil
+}
+
+// Returns the thresholds in the format of the widget forms.
+func (c GaugeWidgetConfig) ThresholdsText() string {
+	var parts []string
+	for _, threshold := range c.Thresholds {
+		parts = append(parts, strconv.FormatFloat(threshold.From, 'f', -1, 64) + ":" + threshold.Color)
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Places the value on the scale of the gauge, values outside the range stick
+// to its ends.
+func (c GaugeWidgetConfig) Data(value string, receivedAt time.Time) (GaugeWidgetData, error) {
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return GaugeWidgetData{}, fmt.Errorf("value %q is not a number", value)
+	}
+
+	data := GaugeWidgetData{
+		Value: number,
+		Text: strconv.FormatFloat(number, 'f', c.Precision, 64),
+		Position: c.position(number),
+		Bands: []GaugeBand{},
+		ReceivedAt: receivedAt,
+		StaleAfter: c.StaleAfter,
+		Stale: c.StaleAfter > 0 && time.Since(receivedAt) > time.Duration(c.StaleAfter) * time.Second,
+	}
+
+	for i, threshold := range c.Thresholds {
+		if number >= threshold.From {
+			data.Color = threshold.Color
+		}
+
+		to := c.Max
+		if i + 1 < len(c.Thresholds) {
+			to = c.Thresholds[i + 1].From
+		}
+		if to <= c.Min || threshold.From >= c.Max {
+			continue
+		}
+
+		data.Bands = append(data.Bands, GaugeBand{
+			From: c.position(threshold.From),
+			To: c.position(to),
+			Color: threshold.Color,
+		})
+	}
+
+	return data, nil
+}
+
+func (c GaugeWidgetConfig) position(number float64) float64 {
+	return math.Max(0, math.Min(1, (number - c.Min) / (c.Max - c.Min)))
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
+	"log"
 	"net/http"
 
 	"github.com/gorilla/sessions"
@@ -15,3 +18,31 @@ func GetAuthSession(store *sessions.CookieStore, r *http.Request) *sessions.Sess
 
 	return session
 }
+
+// Adds a column to an existing table, used to migrate databases that were
+// created before the column existed.
+func addColumnIfNotExists(db *sql.DB, table string, column string, definition string) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		log.Fatalln("Unable to read table info of", table, err.Error())
+	}
+
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			log.Fatalln("Unable to read table info of", table, err.Error())
+		}
+
+		if name == column {
+			rows.Close()
+			return
+		}
+	}
+
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		log.Fatalln("Unable to add column", column, "to", table, err.Error())
+	}
+}
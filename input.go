@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	InputString string = "STRING"
+	InputNumber string = "NUMBER"
+	InputBoolean string = "BOOLEAN"
+	InputSelect string = "SELECT"
+
+	InputPlain string = "PLAIN" // the value of the only field is the payload
+	InputJSON string = "JSON" // the fields are the keys of a JSON object
+)
+
+var inputFieldTypes = []string{InputString, InputNumber, InputBoolean, InputSelect}
+
+// InputField is a field of the form of an INPUT widget. Min and Max limit
+// numbers, or the length of strings. Pattern must match the whole string.
+type InputField struct {
+	Name string
+	Type string
+	Min *float64
+	Max *float64
+	Pattern string
+	Options []string // of SELECT fields
+	Optional bool
+}
+
+// Reads the input specific fields of the widget forms.
+func parseInputForm(r *http.Request) (InputWidgetConfig, error) {
+	config := InputWidgetConfig{
+		Format: r.FormValue("format"),
+	}
+
+	if config.Format == "" {
+		config.Format = InputPlain
+	}
+	if config.Format != InputPlain && config.Format != InputJSON {
+		return config, fmt.Errorf("invalid payload format %q", config.Format)
+	}
+
+	var err error
+	config.Fields, err = parseInputFields(r.FormValue("fields"))
+	if err != nil {
+		return config, err
+	}
+	if len(config.Fields) == 0 {
+		return config, fmt.Errorf("at least one field is required")
+	}
+	if config.Format == InputPlain && len(config.Fields) != 1 {
+		return config, fmt.Errorf("plain payloads have exactly one field, use the JSON format for more")
+	}
+
+	return config, nil
+}
+
+// Parses one field per line written as "name type" followed by the options
+// min=, max=, pattern=, options=a|b|c and optional, e.g. "offset number
+// min=-10 max=10".
+func parseInputFields(text string) ([]InputField, error) {
+	var fields []InputField
+	for _, line := range strings.Split(text, "\n") {
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		if len(words) < 2 {
+			return nil, fmt.Errorf("invalid field %q, expected name and type", strings.TrimSpace(line))
+		}
+
+		field := InputField{
+			Name: words[0],
+			Type: strings.ToUpper(words[1]),
+		}
+		if !slices.Contains(inputFieldTypes, field.Type) {
+			return nil, fmt.Errorf("%s: invalid type %q, must be string, number, boolean or select", field.Name, words[1])
+		}
+		if slices.ContainsFunc(fields, func(other InputField) bool { return other.Name == field.Name }) {
+			return nil, fmt.Errorf("%s: duplicate field", field.Name)
+		}
+
+		for _, word := range words[2:] {
+			if word == "optional" {
+				field.Optional = true
+				continue
+			}
+
+			key, value, found := strings.Cut(word, "=")
+			if !found {
+				return nil, fmt.Errorf("%s: invalid option %q", field.Name, word)
+			}
+
+			switch key {
+			case "min", "max":
+				number, err := parseNumberField(value, 0)
+				if err != nil || value == "" {
+					return nil, fmt.Errorf("%s: %s must be a number", field.Name, key)
+				}
+				if key == "min" {
+					field.Min = &number
+				} else {
+					field.Max = &number
+				}
+			case "pattern":
+				if _, err := regexp.Compile("^(?:" + value + ")$"); err != nil {
+					return nil, fmt.Errorf("%s: invalid pattern: %w", field.Name, err)
+				}
+				field.Pattern = value
+			case "options":
+				field.Options = strings.Split(value, "|")
+			default:
+				return nil, fmt.Errorf("%s: unknown option %q", field.Name, key)
+			}
+		}
+
+		if field.Type == InputSelect && len(field.Options) == 0 {
+			return nil, fmt.Errorf("%s: select fields need options=a|b|c", field.Name)
+		}
+		if field.Min != nil && field.Max != nil && *field.Min > *field.Max {
+			return nil, fmt.Errorf("%s: min must not be greater than max", field.Name)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// Returns the fields in the format of the widget forms.
+func (c InputWidgetConfig) FieldsText() string {
+	var lines []string
+	for _, field := range c.Fields {
+		words := []string{field.Name, strings.ToLower(field.Type)}
+		if field.Min != nil {
+			words = append(words, "min=" + strconv.FormatFloat(*field.Min, 'f', -1, 64))
+		}
+		if field.Max != nil {
+			words = append(words, "max=" + strconv.FormatFloat(*field.Max, 'f', -1, 64))
+		}
+		if field.Pattern != "" {
+			words = append(words, "pattern=" + field.Pattern)
+		}
+		if len(field.Options) > 0 {
+			words = append(words, "options=" + strings.Join(field.Options, "|"))
+		}
+		if field.Optional {
+			words = append(words, "optional")
+		}
+		lines = append(lines, strings.Join(words, " "))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Validates the submitted value, a JSON object of the field texts, and
+// composes the payload.
+func (c InputWidgetConfig) Payload(value string) ([]byte, error) {
+	var texts map[string]string
+	if err := json.Unmarshal([]byte(value), &texts); err != nil {
+		return nil, fmt.Errorf("invalid input value: %w", err)
+	}
+
+	// built by hand to keep the keys in the order of the fields
+	var members []string
+	for _, field := range c.Fields {
+		text := texts[field.Name]
+		if text == "" && field.Type != InputBoolean {
+			if !field.Optional {
+				return nil, fmt.Errorf("%s is required", field.Name)
+			}
+			if c.Format == InputPlain {
+				return []byte{}, nil
+			}
+			continue
+		}
+
+		typed, err := field.Value(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field.Name, err)
+		}
+
+		if c.Format == InputPlain {
+			if field.Type == InputString || field.Type == InputSelect {
+				return []byte(text), nil
+			}
+			return json.Marshal(typed)
+		}
+
+		name, _ := json.Marshal(field.Name)
+		member, err := json.Marshal(typed)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, string(name) + ":" + string(member))
+	}
+
+	return []byte("{" + strings.Join(members, ",") + "}"), nil
+}
+
+// Converts the text of the field to its JSON value.
+func (f InputField) Value(text string) (any, error) {
+	switch f.Type {
+	case InputNumber:
+		number, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, fmt.Errorf("%q is not a number", text)
+		}
+		if f.Min != nil && number < *f.Min {
+			return nil, fmt.Errorf("must be at least %s", strconv.FormatFloat(*f.Min, 'f', -1, 64))
+		}
+		if f.Max != nil && number > *f.Max {
+			return nil, fmt.Errorf("must be at most %s", strconv.FormatFloat(*f.Max, 'f', -1, 64))
+		}
+		return json.Number(strconv.FormatFloat(number, 'f', -1, 64)), nil
+	case InputBoolean:
+		switch text {
+		case "", "false":
+			return false, nil
+		case "true":
+			return true, nil
+		}
+		return nil, fmt.Errorf("%q is not true or false", text)
+	case InputSelect:
+		if !slices.Contains(f.Options, text) {
+			return nil, fmt.Errorf("%q is not one of %s", text, strings.Join(f.Options, ", "))
+		}
+		return text, nil
+	}
+
+	length := float64(utf8.RuneCountInString(text))
+	if f.Min != nil && length < *f.Min {
+		return nil, fmt.Errorf("must be at least %s characters", strconv.FormatFloat(*f.Min, 'f', -1, 64))
+	}
+	if f.Max != nil && length > *f.Max {
+		return nil, fmt.Errorf("must be at most %s characters", strconv.FormatFloat(*f.Max, 'f', -1, 64))
+	}
+	if f.Pattern != "" && !regexp.MustCompile("^(?:" + f.Pattern + ")$").MatchString(text) {
+		return nil, fmt.Errorf("%q does not match %s", text, f.Pattern)
+	}
+
+	return text, nil
+}
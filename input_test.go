@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseInputFields(t *testing.T) {
+	text := `
+		offset number min=-10 max=10.5
+		label string max=8 pattern=[a-z]+ optional
+
+		mode select options=auto|manual
+		enabled boolean
+	`
+
+	fields, err := parseInputFields(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "offset number min=-10 max=10.5\nlabel string max=8 pattern=[a-z]+ optional\nmode select options=auto|manual\nenabled boolean"
+	if got := (InputWidgetConfig{Fields: fields}).FieldsText(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseInputFieldsErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		err string
+	}{
+		{"offset", "expected name and type"},
+		{"offset float", "invalid type"},
+		{"a string\na number", "duplicate field"},
+		{"a string required", "invalid option"},
+		{"a string size=3", "unknown option"},
+		{"a number min=low", "min must be a number"},
+		{"a number max=", "max must be a number"},
+		{"a number min=5 max=1", "min must not be greater than max"},
+		{"a string pattern=[a-", "invalid pattern"},
+		{"a select", "need options"},
+	}
+
+	for _, test := range tests {
+		_, err := parseInputFields(test.text)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %q", test.text, err, test.err)
+		}
+	}
+}
+
+func TestInputFieldValue(t *testing.T) {
+	fields, err := parseInputFields(`
+		number number min=-1.5 max=10
+		name string min=2 max=4
+		code string pattern=[A-Z]{2}\d+
+		mode select options=auto|manual
+		enabled boolean
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field int
+		text string
+		want string // JSON of the value
+		err string
+	}{
+		{0, "-1.5", "-1.5", ""},
+		{0, " 10 ", "10", ""},
+		{0, "1e1", "10", ""},
+		{0, "-1.6", "", "must be at least -1.5"},
+		{0, "10.01", "", "must be at most 10"},
+		{0, "ten", "", "is not a number"},
+		{0, "NaN", "", "is not a number"},
+		{1, "ab", `"ab"`, ""},
+		{1, "äöüß", `"äöüß"`, ""},
+		{1, "a", "", "must be at least 2 characters"},
+		{1, "abcde", "", "must be at most 4 characters"},
+		{2, "AB12", `"AB12"`, ""},
+		{2, "xAB12", "", "does not match"},
+		{2, "AB12x", "", "does not match"},
+		{3, "manual", `"manual"`, ""},
+		{3, "Manual", "", "is not one of auto, manual"},
+		{4, "", "false", ""},
+		{4, "true", "true", ""},
+		{4, "yes", "", "is not true or false"},
+	}
+
+	for _, test := range tests {
+		field := fields[test.field]
+		value, err := field.Value(test.text)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s %q: got error %v, want %q", field.Name, test.text, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: %v", field.Name, test.text, err)
+			continue
+		}
+
+		if got, _ := json.Marshal(value); string(got) != test.want {
+			t.Errorf("%s %q: got %s, want %s", field.Name, test.text, got, test.want)
+		}
+	}
+}
+
+func TestInputWidgetConfigPayload(t *testing.T) {
+	jsonFields, err := parseInputFields("zone string\nsetpoint number max=30\nnote string optional\neco boolean")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainNumber, err := parseInputFields("setpoint number")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainOptional, err := parseInputFields("note string optional")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		config InputWidgetConfig
+		value string
+		want string
+		err string
+	}{
+		{"keys in field order", InputWidgetConfig{Format: InputJSON, Fields: jsonFields},
+			`{"eco":"true","setpoint":"21.50","zone":"hall","note":"hi"}`, `{"zone":"hall","setpoint":21.5,"note":"hi","eco":true}`, ""},
+		{"optional field left out", InputWidgetConfig{Format: InputJSON, Fields: jsonFields},
+			`{"zone":"hall","setpoint":"21"}`, `{"zone":"hall","setpoint":21,"eco":false}`, ""},
+		{"required field missing", InputWidgetConfig{Format: InputJSON, Fields: jsonFields},
+			`{"setpoint":"21"}`, "", "zone is required"},
+		{"invalid field", InputWidgetConfig{Format: InputJSON, Fields: jsonFields},
+			`{"zone":"hall","setpoint":"31"}`, "", "setpoint: must be at most 30"},
+		{"plain number", InputWidgetConfig{Format: InputPlain, Fields: plainNumber},
+			`{"setpoint":"007"}`, "7", ""},
+		{"plain string", InputWidgetConfig{Format: InputPlain, Fields: plainOptional},
+			`{"note":"a \"quoted\" note"}`, `a "quoted" note`, ""},
+		{"plain optional field left out", InputWidgetConfig{Format: InputPlain, Fields: plainOptional},
+			`{}`, "", ""},
+		{"value that is no object", InputWidgetConfig{Format: InputPlain, Fields: plainOptional},
+			`"note"`, "", "invalid input value"},
+	}
+
+	for _, test := range tests {
+		got, err := test.config.Payload(test.value)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
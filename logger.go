@@ -2,8 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"html/template"
 	"log"
+	"net/http"
 	"time"
+
+	"github.com/gorilla/sessions"
 )
 
 const (
@@ -14,14 +19,21 @@ const (
 
 type Log struct {
 	ID int
+	ProjectID int
 	Type int
 	Text string
 	CreatedAt time.Time
 }
 
+type ProjectLogsViewData struct {
+	Project	*Project
+	Logs	[]Log
+}
+
 func createLogsTable(db *sql.DB) {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS logs(
 		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		project_id INTEGER NOT NULL DEFAULT 0,
 		type INTEGER,
 		text TEXT,
 		created_at DATETIME
@@ -31,3 +43,78 @@ func createLogsTable(db *sql.DB) {
 		panic(err)
 	}
 }
+
+// Brings logs tables of older databases up to date.
+func migrateLogsTable(db *sql.DB) {
+	addColumnIfNotExists(db, "logs", "project_id", "INTEGER NOT NULL DEFAULT 0")
+}
+
+func createLog(db *sql.DB, projectID int, logType int, text string) {
+	_, err := db.Exec("INSERT INTO logs(project_id, type, text, created_at) VALUES(?,?,?,?)", projectID, logType, text, time.Now())
+	if err != nil {
+		log.Println("Unable to write log:", err)
+	}
+}
+
+func getProjectLogs(db *sql.DB, projectID int, maxLength int) ([]Log, error) {
+	var logs []Log
+
+	rows, err := db.Query("SELECT id, project_id, type, text, created_at FROM logs WHERE project_id = ? ORDER BY id DESC LIMIT ?", projectID, maxLength)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var logRow Log
+		err = rows.Scan(&logRow.ID, &logRow.ProjectID, &logRow.Type, &logRow.Text, &logRow.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		logs = append(logs, logRow)
+	}
+
+	rows.Close()
+
+	return logs, nil
+}
+
+func (l Log) TypeText() string {
+	switch l.Type {
+	case LogWarning:
+		return "WARNING"
+	case LogError:
+		return "ERROR"
+	}
+
+	return "INFO"
+}
+
+func projectLogsHandler(db *sql.DB, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		logs, err := getProjectLogs(db, project.ID, 200)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		tmpl := template.Must(template.ParseFiles("./views/layout.html", "./views/project-logs.html"))
+		tmpl.Execute(w, ProjectLogsViewData{
+			Project: project,
+			Logs: logs,
+		})
+	}
+}
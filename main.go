@@ -44,7 +44,13 @@ func main() {
 		createTeamsTable(db)
 	}
 
-	var connections []*Connection
+	migrateProjectsTable(db)
+	migrateLogsTable(db)
+	migrateDataLogsTable(db)
+
+	loadSecretKey()
+
+	connections := NewConnectionManager()
 
 	bundle := i18n.NewBundle(language.English)
 	bundle.RegisterUnmarshalFunc("toml", toml.Unmarshal)
@@ -63,17 +69,33 @@ func main() {
 	mux.HandleFunc("/projects", projectsHandler(db, localizer, store))
 	mux.HandleFunc("/projects/{slug}", projectViewHandler(db, localizer, store))
 	mux.HandleFunc("/projects/{slug}/new-section", projectNewSectionHandler(db, store))
-	mux.HandleFunc("/projects/{slug}/new-widget", projectNewWidgetHandler(db, store))
-	mux.HandleFunc("/projects/{slug}/connect", projectConnectHandler(db, &connections, store))
-	mux.HandleFunc("/projects/{slug}/disconnect", projectDisconnectHandler(db, &connections, store))
-	mux.HandleFunc("/projects/{slug}/connection", projectConnectionHandler(db, &connections, store))
-	mux.HandleFunc("/projects/{slug}/data", projectDataHandler(db, &connections, store))
-	mux.HandleFunc("/projects/{slug}/submit-value", projectSubmitValueHandler(db, &connections, store))
-	mux.HandleFunc("/projects/{slug}/delete-widget", projectDeleteWidgetHandler(db, store))
-	mux.HandleFunc("/projects/{slug}/edit-widget", projectEditWidgetHandler(db, store))
+	mux.HandleFunc("/projects/{slug}/new-widget", projectNewWidgetHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/connect", projectConnectHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/disconnect", projectDisconnectHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/connection", projectConnectionHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/data", projectDataHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/ws", projectSocketHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/events", projectEventsHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/buffer", projectBufferHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/submit-value", projectSubmitValueHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/switch", projectSwitchHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/delete-widget", projectDeleteWidgetHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/edit-widget", projectEditWidgetHandler(db, connections, store))
 	mux.HandleFunc("/projects/{slug}/edit-section", projectEditSectionHandler(db, store))
-	mux.HandleFunc("/projects/{slug}/delete-section", projectDeleteSectionHandler(db, store))
+	mux.HandleFunc("/projects/{slug}/delete-section", projectDeleteSectionHandler(db, connections, store))
 	mux.HandleFunc("/projects/{slug}/settings", projectSettingsViewHandler(db, store))
+	mux.HandleFunc("/projects/{slug}/logs", projectLogsHandler(db, store))
+	mux.HandleFunc("/projects/{slug}/explorer", projectExplorerHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/explorer/tree", projectExplorerTreeHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/console", projectConsoleHandler(db, store))
+	mux.HandleFunc("/projects/{slug}/console/publish", projectConsolePublishHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/console/events", projectConsoleEventsHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/discovery", projectDiscoveryHandler(db, store))
+	mux.HandleFunc("/projects/{slug}/discovery/entities", projectDiscoveryEntitiesHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/discovery/import", projectDiscoveryImportHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/sparkplug", projectSparkplugHandler(db, store))
+	mux.HandleFunc("/projects/{slug}/sparkplug/nodes", projectSparkplugNodesHandler(db, connections, store))
+	mux.HandleFunc("/projects/{slug}/sparkplug/rebirth", projectSparkplugRebirthHandler(db, connections, store))
 
 	// Account routes
 	mux.HandleFunc("/account", accountHandler(db, store))
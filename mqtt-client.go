@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+const (
+	MQTTVersion311 int = 4
+	MQTTVersion5 int = 5
+)
+
+var mqttVersions = []int{MQTTVersion311, MQTTVersion5}
+
+type UserProperty struct {
+	Key string
+	Value string
+}
+
+// MessageProperties holds the MQTT 5 publish properties, 3.1.1 brokers never
+// send them and they are dropped when publishing to one.
+type MessageProperties struct {
+	ContentType string `json:",omitempty"`
+	ResponseTopic string `json:",omitempty"`
+	CorrelationData []byte `json:",omitempty"`
+	MessageExpiry uint32 `json:",omitempty"` // seconds, 0 means no expiry
+	UserProperties []UserProperty `json:",omitempty"`
+}
+
+// mqttClient hides the differences between the MQTT 3.1.1 and MQTT 5 client
+// libraries. Every call blocks until the broker answered and failures carry
+// the reason reported by the broker.
+type mqttClient interface {
+	Connect() error
+	Subscribe(topic string, qos byte) error
+	Unsubscribe(topic string) error
+	Publish(message Message) error
+	IsConnected() bool
+	Disconnect()
+}
+
+// Callbacks a client calls from its own goroutines.
+type clientHandlers struct {
+	OnConnect func()
+	OnConnectionLost func(err error)
+	OnReconnecting func()
+	OnMessage func(message Message)
+}
+
+func newMQTTClient(c *Connection, handlers clientHandlers) mqttClient {
+	if c.ProtocolVersion == MQTTVersion5 {
+		return newMQTT5Client(c, handlers)
+	}
+
+	return newMQTT3Client(c, handlers)
+}
+
+// Parses user properties given as one "key: value" pair per line, keys may
+// repeat.
+func parseUserProperties(text string) ([]UserProperty, error) {
+	var properties []UserProperty
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid user property %q, expected \"key: value\"", line)
+		}
+
+		properties = append(properties, UserProperty{
+			Key: strings.TrimSpace(key),
+			Value: strings.TrimSpace(value),
+		})
+	}
+
+	return properties, nil
+}
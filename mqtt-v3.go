@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqtt3Client speaks MQTT 3.1.1 through paho.mqtt.golang.
+type mqtt3Client struct {
+	client mqtt.Client
+}
+
+func init() {
+	mqtt.ERROR = log.New(os.Stdout, "[ERROR] ", 0)
+	mqtt.CRITICAL = log.New(os.Stdout, "[CRIT] ", 0)
+	mqtt.WARN = log.New(os.Stdout, "[WARN]  ", 0)
+	mqtt.DEBUG = log.New(os.Stdout, "[DEBUG] ", 0)
+}
+
+func newMQTT3Client(c *Connection, handlers clientHandlers) *mqtt3Client {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(c.Broker)
+	opts.SetClientID(c.ClientID)
+	if c.Username != "" {
+		opts.SetUsername(c.Username)
+	}
+	if c.Password != "" {
+		opts.SetPassword(c.Password)
+	}
+	if c.TLSConfig != nil {
+		opts.SetTLSConfig(c.TLSConfig)
+	}
+	if len(c.HTTPHeaders) > 0 {
+		opts.SetHTTPHeaders(c.HTTPHeaders)
+	}
+
+	if c.Will.Topic != "" {
+		// the broker publishes it when the connection drops without a disconnect
+		opts.SetWill(c.Will.Topic, c.Will.Payload, c.Will.QoS, c.Will.Retain)
+	}
+
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(2 * time.Minute) // paho doubles the delay up to this
+
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		handlers.OnConnect()
+	})
+
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		handlers.OnConnectionLost(err)
+	})
+
+	opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		handlers.OnReconnecting()
+	})
+
+	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+		handlers.OnMessage(Message{
+			Topic: msg.Topic(),
+			Payload: msg.Payload(),
+			QoS: msg.Qos(),
+			Retained: msg.Retained(),
+			ReceivedAt: time.Now(),
+		})
+	})
+
+	return &mqtt3Client{
+		client: mqtt.NewClient(opts),
+	}
+}
+
+func (m *mqtt3Client) Connect() error {
+	token := m.client.Connect()
+	token.Wait()
+	return token.Error()
+}
+
+func (m *mqtt3Client) Subscribe(topic string, qos byte) error {
+	token := m.client.Subscribe(topic, qos, nil)
+	if !token.WaitTimeout(10 * time.Second) {
+		return errors.New("timed out waiting for the broker")
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+
+	// 3.1.1 brokers answer 0x80 when they refuse the subscription
+	if code, found := token.(*mqtt.SubscribeToken).Result()[topic]; found && code >= 0x80 {
+		return fmt.Errorf("subscription refused by the broker (return code 0x%02x)", code)
+	}
+
+	return nil
+}
+
+func (m *mqtt3Client) Unsubscribe(topic string) error {
+	token := m.client.Unsubscribe(topic)
+	if !token.WaitTimeout(10 * time.Second) {
+		return errors.New("timed out waiting for the broker")
+	}
+
+	return token.Error()
+}
+
+func (m *mqtt3Client) Publish(message Message) error {
+	token := m.client.Publish(message.Topic, message.QoS, message.Retained, message.Payload)
+	if !token.WaitTimeout(10 * time.Second) {
+		return errors.New("timed out waiting for the broker")
+	}
+
+	return token.Error()
+}
+
+func (m *mqtt3Client) IsConnected() bool {
+	return m.client.IsConnectionOpen()
+}
+
+func (m *mqtt3Client) Disconnect() {
+	m.client.Disconnect(250)
+}
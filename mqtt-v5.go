@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// mqtt5Client speaks MQTT 5 through paho.golang, autopaho takes care of
+// reconnecting.
+type mqtt5Client struct {
+	config autopaho.ClientConfig
+	handlers clientHandlers
+
+	mutex sync.Mutex
+	manager *autopaho.ConnectionManager
+	connected bool
+	connectedOnce bool
+	connectErrors chan error // failures before the first connection
+}
+
+func newMQTT5Client(c *Connection, handlers clientHandlers) *mqtt5Client {
+	m := &mqtt5Client{
+		handlers: handlers,
+		connectErrors: make(chan error, 1),
+	}
+
+	m.config = autopaho.ClientConfig{
+		TlsCfg: c.TLSConfig,
+		KeepAlive: 30,
+		CleanStartOnInitialConnection: true,
+		ReconnectBackoff: autopaho.NewExponentialBackoff(time.Second, 2 * time.Minute, 2 * time.Second, 2),
+		ConnectUsername: c.Username,
+		ConnectPassword: []byte(c.Password),
+		OnConnectionUp: func(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+			m.mutex.Lock()
+			m.manager = manager
+			m.connected = true
+			m.connectedOnce = true
+			m.mutex.Unlock()
+
+			// autopaho waits for this callback, subscribing must not hold it up
+			go handlers.OnConnect()
+		},
+		OnConnectError: func(err error) {
+			m.mutex.Lock()
+			connectedOnce := m.connectedOnce
+			m.mutex.Unlock()
+
+			if !connectedOnce {
+				select {
+				case m.connectErrors <- err:
+				default:
+				}
+				return
+			}
+
+			handlers.OnReconnecting()
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: c.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(received paho.PublishReceived) (bool, error) {
+					handlers.OnMessage(messageFromPublish(received.Packet))
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				m.connectionLost(err)
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				reason := (&packets.Disconnect{ReasonCode: disconnect.ReasonCode}).Reason()
+				if disconnect.Properties != nil && disconnect.Properties.ReasonString != "" {
+					reason = disconnect.Properties.ReasonString
+				}
+
+				m.connectionLost(fmt.Errorf("disconnected by the broker: %s", reason))
+			},
+		},
+	}
+
+	if len(c.HTTPHeaders) > 0 {
+		headers := c.HTTPHeaders.Clone()
+		m.config.WebSocketCfg = &autopaho.WebSocketConfig{
+			Header: func(url *url.URL, tlsCfg *tls.Config) http.Header {
+				return headers
+			},
+		}
+	}
+
+	if c.Will.Topic != "" {
+		m.config.WillMessage = &paho.WillMessage{
+			Topic: c.Will.Topic,
+			Payload: []byte(c.Will.Payload),
+			QoS: c.Will.QoS,
+			Retain: c.Will.Retain,
+		}
+	}
+
+	broker, err := url.Parse(c.Broker)
+	if err == nil {
+		m.config.ServerUrls = []*url.URL{broker}
+	}
+
+	return m
+}
+
+func (m *mqtt5Client) connectionLost(err error) {
+	m.mutex.Lock()
+	wasConnected := m.connected
+	m.connected = false
+	m.mutex.Unlock()
+
+	if wasConnected {
+		m.handlers.OnConnectionLost(err)
+	}
+}
+
+// Connects and waits for the first connection, unlike autopaho it gives up
+// when the first attempt fails.
+func (m *mqtt5Client) Connect() error {
+	if len(m.config.ServerUrls) == 0 {
+		return errors.New("invalid broker URL")
+	}
+
+	manager, err := autopaho.NewConnection(context.Background(), m.config)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	m.manager = manager
+	m.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+	defer cancel()
+
+	connected := make(chan error, 1)
+	go func() {
+		connected <- manager.AwaitConnection(ctx)
+	}()
+
+	select {
+	case err = <-connected:
+	case err = <-m.connectErrors:
+	}
+
+	if err != nil {
+		manager.Disconnect(context.Background())
+		return err
+	}
+
+	return nil
+}
+
+func (m *mqtt5Client) getManager() (*autopaho.ConnectionManager, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.manager == nil || !m.connected {
+		return nil, errors.New("not connected to the broker")
+	}
+
+	return m.manager, nil
+}
+
+func (m *mqtt5Client) Subscribe(topic string, qos byte) error {
+	manager, err := m.getManager()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	suback, err := manager.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: topic, QoS: qos},
+		},
+	})
+	if suback != nil && len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		var reasonString string
+		if suback.Properties != nil {
+			reasonString = suback.Properties.ReasonString
+		}
+
+		return fmt.Errorf("subscription refused by the broker: %s", reasonText(suback.Reasons[0], reasonString, (&packets.Suback{Reasons: suback.Reasons}).Reason(0)))
+	}
+
+	return err
+}
+
+func (m *mqtt5Client) Unsubscribe(topic string) error {
+	manager, err := m.getManager()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err = manager.Unsubscribe(ctx, &paho.Unsubscribe{
+		Topics: []string{topic},
+	})
+	return err
+}
+
+func (m *mqtt5Client) Publish(message Message) error {
+	manager, err := m.getManager()
+	if err != nil {
+		return err
+	}
+
+	publish := &paho.Publish{
+		Topic: message.Topic,
+		Payload: message.Payload,
+		QoS: message.QoS,
+		Retain: message.Retained,
+	}
+
+	if message.Properties != nil {
+		publish.Properties = &paho.PublishProperties{
+			ContentType: message.Properties.ContentType,
+			ResponseTopic: message.Properties.ResponseTopic,
+			CorrelationData: message.Properties.CorrelationData,
+		}
+		if message.Properties.MessageExpiry > 0 {
+			expiry := message.Properties.MessageExpiry
+			publish.Properties.MessageExpiry = &expiry
+		}
+		for _, property := range message.Properties.UserProperties {
+			publish.Properties.User.Add(property.Key, property.Value)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	response, err := manager.Publish(ctx, publish)
+
+	// QoS 2 refusals arrive as PUBREC without an error
+	if response != nil && response.ReasonCode >= 0x80 {
+		var reasonString string
+		if response.Properties != nil {
+			reasonString = response.Properties.ReasonString
+		}
+
+		return fmt.Errorf("publish refused by the broker: %s", reasonText(response.ReasonCode, reasonString, (&packets.Pubrec{ReasonCode: response.ReasonCode}).Reason()))
+	}
+
+	return err
+}
+
+func (m *mqtt5Client) IsConnected() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.connected
+}
+
+func (m *mqtt5Client) Disconnect() {
+	m.mutex.Lock()
+	manager := m.manager
+	m.connected = false
+	m.mutex.Unlock()
+
+	if manager == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	manager.Disconnect(ctx)
+}
+
+// Formats a reason code the way it is shown in the logs, the reason string
+// sent by the broker is preferred over the description from the spec.
+func reasonText(code byte, reasonString string, description string) string {
+	if reasonString != "" {
+		description = reasonString
+	}
+
+	return fmt.Sprintf("%s (reason code 0x%02x)", description, code)
+}
+
+// Converts a received PUBLISH packet, properties are only kept when the broker
+// sent any.
+func messageFromPublish(publish *paho.Publish) Message {
+	message := Message{
+		Topic: publish.Topic,
+		Payload: publish.Payload,
+		QoS: publish.QoS,
+		Retained: publish.Retain,
+		ReceivedAt: time.Now(),
+	}
+
+	if publish.Properties == nil {
+		return message
+	}
+
+	properties := MessageProperties{
+		ContentType: publish.Properties.ContentType,
+		ResponseTopic: publish.Properties.ResponseTopic,
+		CorrelationData: publish.Properties.CorrelationData,
+	}
+	if publish.Properties.MessageExpiry != nil {
+		properties.MessageExpiry = *publish.Properties.MessageExpiry
+	}
+	for _, property := range publish.Properties.User {
+		properties.UserProperties = append(properties.UserProperties, UserProperty{
+			Key: property.Key,
+			Value: property.Value,
+		})
+	}
+
+	if properties.ContentType != "" || properties.ResponseTopic != "" || properties.CorrelationData != nil || properties.MessageExpiry > 0 || len(properties.UserProperties) > 0 {
+		message.Properties = &properties
+	}
+
+	return message
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// PayloadDecoder turns a binary payload into a JSON-like value: maps with
+// string keys, slices, strings, numbers, booleans, nil or json.RawMessage.
+type PayloadDecoder interface {
+	Decode(payload []byte) (any, error)
+}
+
+// PayloadDecoderFactory creates the decoder of a rule, argument is the text
+// after the decoder name, e.g. the message type of protobuf rules.
+type PayloadDecoderFactory func(project *Project, argument string) (PayloadDecoder, error)
+
+var payloadDecoderFactories = map[string]PayloadDecoderFactory{}
+
+// Makes a decoder available to the decoder rules of all projects.
+func RegisterPayloadDecoder(name string, factory PayloadDecoderFactory) {
+	payloadDecoderFactories[name] = factory
+}
+
+func payloadDecoderNames() []string {
+	var names []string
+	for name := range payloadDecoderFactories {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+func init() {
+	RegisterPayloadDecoder("hex", func(project *Project, argument string) (PayloadDecoder, error) {
+		return hexDecoder{}, nil
+	})
+	RegisterPayloadDecoder("base64", func(project *Project, argument string) (PayloadDecoder, error) {
+		return base64Decoder{}, nil
+	})
+	RegisterPayloadDecoder("cbor", func(project *Project, argument string) (PayloadDecoder, error) {
+		return cborDecoder{}, nil
+	})
+	RegisterPayloadDecoder("msgpack", func(project *Project, argument string) (PayloadDecoder, error) {
+		return msgpackDecoder{}, nil
+	})
+	RegisterPayloadDecoder("protobuf", newProtobufDecoder)
+}
+
+// PayloadDecoders holds the decoder rules of a project, the first rule whose
+// topic filter matches decodes the payload. A nil value decodes nothing.
+type PayloadDecoders struct {
+	rules []payloadDecoderRule
+}
+
+type payloadDecoderRule struct {
+	filter string
+	decoder PayloadDecoder
+}
+
+// Parses the decoder rules of the project, one "topic filter: decoder
+// [argument]" per line.
+func newPayloadDecoders(project *Project) (*PayloadDecoders, error) {
+	decoders := &PayloadDecoders{}
+
+	scanner := bufio.NewScanner(strings.NewReader(project.PayloadDecoders))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		filter, definition, found := strings.Cut(line, ":")
+		filter = strings.TrimSpace(filter)
+		fields := strings.Fields(definition)
+		if !found || filter == "" || len(fields) == 0 {
+			return nil, fmt.Errorf("invalid decoder rule %q, expected \"topic filter: decoder\"", line)
+		}
+		if err := validateTopicFilter(filter); err != nil {
+			return nil, err
+		}
+
+		factory, found := payloadDecoderFactories[fields[0]]
+		if !found {
+			return nil, fmt.Errorf("unknown payload decoder %q, available are %s", fields[0], strings.Join(payloadDecoderNames(), ", "))
+		}
+
+		decoder, err := factory(project, strings.Join(fields[1:], " "))
+		if err != nil {
+			return nil, fmt.Errorf("decoder rule %q: %w", line, err)
+		}
+
+		decoders.rules = append(decoders.rules, payloadDecoderRule{
+			filter: filter,
+			decoder: decoder,
+		})
+	}
+
+	return decoders, nil
+}
+
+// Reports whether a rule decodes payloads of the topic.
+func (d *PayloadDecoders) Matches(topic string) bool {
+	return d.decoder(topic) != nil
+}
+
+func (d *PayloadDecoders) decoder(topic string) PayloadDecoder {
+	if d == nil {
+		return nil
+	}
+
+	for _, rule := range d.rules {
+		if topicMatches(rule.filter, topic) {
+			return rule.decoder
+		}
+	}
+
+	return nil
+}
+
+// Returns the payload as text: decoded strings as they are, other decoded
+// values as JSON and payloads without a decoder unchanged.
+func (d *PayloadDecoders) Decode(topic string, payload []byte) ([]byte, error) {
+	decoder := d.decoder(topic)
+	if decoder == nil {
+		return payload, nil
+	}
+
+	value, err := decoder.Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if text, ok := value.(string); ok {
+		return []byte(text), nil
+	}
+
+	return json.Marshal(value)
+}
+
+// hexDecoder shows binary payloads as hex digits.
+type hexDecoder struct{}
+
+func (hexDecoder) Decode(payload []byte) (any, error) {
+	return hex.EncodeToString(payload), nil
+}
+
+// base64Decoder shows binary payloads as standard base64.
+type base64Decoder struct{}
+
+func (base64Decoder) Decode(payload []byte) (any, error) {
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+type cborDecoder struct{}
+
+func (cborDecoder) Decode(payload []byte) (any, error) {
+	var value any
+	if err := cbor.Unmarshal(payload, &value); err != nil {
+		return nil, fmt.Errorf("invalid CBOR payload: %w", err)
+	}
+
+	return jsonLikeValue(value), nil
+}
+
+type msgpackDecoder struct{}
+
+func (msgpackDecoder) Decode(payload []byte) (any, error) {
+	decoder := msgpack.NewDecoder(bytes.NewReader(payload))
+	// the default map decoder fails on keys that are not strings
+	decoder.SetMapDecoder(func(decoder *msgpack.Decoder) (any, error) {
+		return decoder.DecodeUntypedMap()
+	})
+	value, err := decoder.DecodeInterface()
+	if err != nil {
+		return nil, fmt.Errorf("invalid MessagePack payload: %w", err)
+	}
+
+	return jsonLikeValue(value), nil
+}
+
+// protobufDecoder decodes one message type of the descriptor set uploaded in
+// the project settings.
+type protobufDecoder struct {
+	message protoreflect.MessageDescriptor
+}
+
+func newProtobufDecoder(project *Project, argument string) (PayloadDecoder, error) {
+	if argument == "" {
+		return nil, errors.New("the protobuf decoder needs a message type, e.g. \"protobuf my.package.Message\"")
+	}
+	if len(project.ProtoDescriptorSet) == 0 {
+		return nil, errors.New("upload a descriptor set (protoc --include_imports --descriptor_set_out) to use the protobuf decoder")
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(project.ProtoDescriptorSet, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(argument))
+	if err != nil {
+		return nil, fmt.Errorf("message type %q not found in the descriptor set", argument)
+	}
+
+	message, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a message type", argument)
+	}
+
+	return protobufDecoder{
+		message: message,
+	}, nil
+}
+
+func (p protobufDecoder) Decode(payload []byte) (any, error) {
+	message := dynamicpb.NewMessage(p.message)
+	if err := proto.Unmarshal(payload, message); err != nil {
+		return nil, fmt.Errorf("invalid %s payload: %w", p.message.FullName(), err)
+	}
+
+	encoded, err := protojson.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(encoded), nil
+}
+
+// Converts decoded CBOR and MessagePack values to values encoding/json can
+// marshal, non string map keys are formatted as text.
+func jsonLikeValue(value any) any {
+	switch value := value.(type) {
+	case map[any]any:
+		converted := make(map[string]any, len(value))
+		for key, item := range value {
+			converted[fmt.Sprint(key)] = jsonLikeValue(item)
+		}
+		return converted
+	case map[string]any:
+		for key, item := range value {
+			value[key] = jsonLikeValue(item)
+		}
+		return value
+	case []any:
+		for i, item := range value {
+			value[i] = jsonLikeValue(item)
+		}
+		return value
+	case cbor.Tag:
+		return jsonLikeValue(value.Content)
+	}
+
+	return value
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Describes the message test.Reading with a double temp and a string name.
+func testDescriptorSet(t *testing.T) *descriptorpb.FileDescriptorSet {
+	t.Helper()
+
+	field := func(name string, number int32, fieldType descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name: proto.String(name),
+			JsonName: proto.String(name),
+			Number: proto.Int32(number),
+			Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type: fieldType.Enum(),
+		}
+	}
+
+	return &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{{
+			Name: proto.String("reading.proto"),
+			Package: proto.String("test"),
+			Syntax: proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("Reading"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("temp", 1, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+					field("name", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				},
+			}},
+		}},
+	}
+}
+
+func testProtobufPayload(t *testing.T, set *descriptorpb.FileDescriptorSet, temp float64, name string) []byte {
+	t.Helper()
+
+	file, err := protodesc.NewFile(set.File[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	descriptor := file.Messages().ByName("Reading")
+	message := dynamicpb.NewMessage(descriptor)
+	message.Set(descriptor.Fields().ByName("temp"), protoreflect.ValueOf(temp))
+	message.Set(descriptor.Fields().ByName("name"), protoreflect.ValueOf(name))
+
+	payload, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return payload
+}
+
+func testEncode(t *testing.T, marshal func(any) ([]byte, error), value any) []byte {
+	t.Helper()
+
+	payload, err := marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return payload
+}
+
+func TestNewPayloadDecodersErrors(t *testing.T) {
+	descriptorSet, err := proto.Marshal(testDescriptorSet(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rules string
+		descriptorSet []byte
+		err string
+	}{
+		{"home/t hex", nil, "expected \"topic filter: decoder\""},
+		{": hex", nil, "expected \"topic filter: decoder\""},
+		{"home/t:", nil, "expected \"topic filter: decoder\""},
+		{"home/#/t: hex", nil, "#"},
+		{"home/t+: hex", nil, "+"},
+		{"home/t: zip", nil, "unknown payload decoder \"zip\", available are base64, cbor, hex, msgpack, protobuf"},
+		{"home/t: protobuf test.Reading", nil, "upload a descriptor set"},
+		{"home/t: protobuf", descriptorSet, "needs a message type"},
+		{"home/t: protobuf test.Missing", descriptorSet, "not found in the descriptor set"},
+		{"home/t: protobuf test.Reading.temp", descriptorSet, "is not a message type"},
+		{"home/t: protobuf test.Reading", []byte("garbage"), "invalid descriptor set"},
+		{"home/t: hex\nhome/h: zip", nil, "unknown payload decoder \"zip\""},
+	}
+
+	for _, test := range tests {
+		_, err := newPayloadDecoders(&Project{PayloadDecoders: test.rules, ProtoDescriptorSet: test.descriptorSet})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %q", test.rules, err, test.err)
+		}
+	}
+}
+
+func TestPayloadDecodersPrecedence(t *testing.T) {
+	decoders, err := newPayloadDecoders(&Project{PayloadDecoders: `
+		home/raw: base64
+		home/#: hex
+		home/raw: hex
+	`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		topic string
+		want string
+	}{
+		{"home/raw", "AAE="},
+		{"home/t", "0001"},
+		{"home", "0001"},
+		{"office/t", "\x00\x01"},
+	}
+
+	for _, test := range tests {
+		got, err := decoders.Decode(test.topic, []byte{0, 1})
+		if err != nil {
+			t.Errorf("%s: %v", test.topic, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.topic, got, test.want)
+		}
+	}
+
+	// projects without rules keep payloads unchanged
+	var none *PayloadDecoders
+	if got, err := none.Decode("home/t", []byte("on")); err != nil || string(got) != "on" || none.Matches("home/t") {
+		t.Errorf("got %q, %v without decoders", got, err)
+	}
+}
+
+func TestPayloadDecodersRoundTrip(t *testing.T) {
+	set := testDescriptorSet(t)
+	descriptorSet, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoders, err := newPayloadDecoders(&Project{
+		PayloadDecoders: "hex/#: hex\nbase64/#: base64\ncbor/#: cbor\nmsgpack/#: msgpack\nprotobuf/#: protobuf test.Reading",
+		ProtoDescriptorSet: descriptorSet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		topic string
+		payload []byte
+		want string
+	}{
+		{"hex/t", []byte{0xde, 0xad, 0xbe, 0xef}, "deadbeef"},
+		{"base64/t", []byte("hi?"), "aGk/"},
+		{"cbor/text", testEncode(t, cbor.Marshal, "21.5"), "21.5"},
+		{"cbor/map", testEncode(t, cbor.Marshal, map[string]any{"temp": 21.5, "tags": []any{"a", true, nil}}),
+			`{"tags":["a",true,null],"temp":21.5}`},
+		{"cbor/int-keys", testEncode(t, cbor.Marshal, map[int]any{1: map[int]string{2: "x"}}), `{"1":{"2":"x"}}`},
+		{"cbor/tag", testEncode(t, cbor.Marshal, cbor.Tag{Number: 4000, Content: map[int]int{1: 2}}), `{"1":2}`},
+		{"msgpack/text", testEncode(t, msgpack.Marshal, "on"), "on"},
+		{"msgpack/map", testEncode(t, msgpack.Marshal, map[string]any{"temp": 21.5, "list": []any{1, "b"}}),
+			`{"list":[1,"b"],"temp":21.5}`},
+		{"msgpack/int-keys", testEncode(t, msgpack.Marshal, map[int]any{1: []any{map[int]bool{2: true}}}), `{"1":[{"2":true}]}`},
+		{"protobuf/t", testProtobufPayload(t, set, 21.5, "kitchen"), `{"temp":21.5,"name":"kitchen"}`},
+	}
+
+	for _, test := range tests {
+		got, err := decoders.Decode(test.topic, test.payload)
+		if err != nil {
+			t.Errorf("%s: %v", test.topic, err)
+			continue
+		}
+
+		// protojson varies its whitespace on purpose
+		var compacted bytes.Buffer
+		if json.Compact(&compacted, got) == nil {
+			got = compacted.Bytes()
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %s, want %s", test.topic, got, test.want)
+		}
+	}
+
+	for _, topic := range []string{"cbor/t", "msgpack/t", "protobuf/t"} {
+		if got, err := decoders.Decode(topic, []byte{0xc1, 0xff, 0xff}); err == nil {
+			t.Errorf("%s: got %s, want an error for an invalid payload", topic, got)
+		}
+	}
+}
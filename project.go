@@ -3,15 +3,29 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/nicksnyder/go-i18n/v2/i18n"
 )
 
+const (
+	BrokerProtocolTCP string = "tcp"
+	BrokerProtocolSSL string = "ssl"
+	BrokerProtocolWS string = "ws"
+	BrokerProtocolWSS string = "wss"
+)
+
+var brokerProtocols = []string{BrokerProtocolTCP, BrokerProtocolSSL, BrokerProtocolWS, BrokerProtocolWSS}
+
 type Project struct {
 	ID int
 	TeamID int
@@ -21,6 +35,31 @@ type Project struct {
 	BrokerAddress string
 	BrokerPort int
 	BrokerProtocol string
+	BrokerProtocolVersion int // MQTTVersion311 or MQTTVersion5
+	BrokerUsername string
+	BrokerPassword string
+	TLSCACert []byte
+	TLSClientCert []byte
+	TLSClientKey []byte
+	TLSClientKeyLost bool // the stored key could not be decrypted
+	TLSServerName string
+	TLSInsecureSkipVerify bool
+	BrokerWebSocketPath string
+	BrokerWebSocketHeaders string
+	BufferDepth int
+	BufferMaxBytes int
+	WillTopic string
+	WillPayload string
+	WillQoS byte
+	WillRetain bool
+	BirthTopic string
+	BirthPayload string
+	BirthQoS byte
+	BirthRetain bool
+	ExplorerFilter string
+	PayloadDecoders string // decoder rules, see newPayloadDecoders
+	ProtoDescriptorSet []byte
+	SparkplugEnabled bool
 	//Sections []ProjectSection
 }
 
@@ -46,25 +85,163 @@ type ProjectViewData struct {
 	Lang		map[string]string
 }
 
+type ProjectSettingsViewData struct {
+	Project		*Project
+	BrokerProtocols	[]string
+	PayloadDecoders	[]string
+}
+
+// ValuePath of the subscribing widgets selects the shown value in JSON
+// payloads, see parseValuePath. Transform is an expression applied to the
+// selected value, see compileExpression.
 type TextWidgetConfig struct {
 	Topic string
+	QoS byte
+	ValuePath string
+	Transform string
 }
 
 type IndicatorWidgetConfig struct {
 	Topic string
-	OnCondition string
+	QoS byte
+	ValuePath string
+	Transform string
+	OnCondition string // an expression or the value that turns it on
 	Color string
 }
 
+type IndicatorWidgetData struct {
+	Value string
+	On bool
+}
+
+// PublishProperties are the MQTT 5 properties publishing widgets add to
+// their messages, they are ignored on MQTT 3.1.1 connections.
+type PublishProperties struct {
+	ContentType string
+	UserProperties []UserProperty
+}
+
 type ButtonWidgetConfig struct {
 	Topic string
+	QoS byte
+	Retain bool
 	Message string
+	PublishProperties
 }
 
-type TimeseriesLineChartWidgetConfig struct {
+const (
+	DefaultRequestTimeout int = 5 // seconds
+	MaxChartSeries int = 10 // topics shown by a chart of a topic filter
+)
+
+// RequestWidgetConfig publishes Payload to Topic and waits for the reply on
+// ResponseTopic, CorrelationField names the JSON field carrying the
+// correlation ID on MQTT 3.1.1 connections.
+type RequestWidgetConfig struct {
+	Topic string
+	QoS byte
+	Payload string
+	ResponseTopic string
+	CorrelationField string
+	Timeout int // seconds
+	ValuePath string // applied to the reply
+	Transform string
+	PublishProperties
+}
+
+// TableWidgetConfig shows one row per topic matching the Topic filter.
+type TableWidgetConfig struct {
+	Topic string
+	QoS byte
+	ValuePath string
+	Transform string
+}
+
+// GaugeWidgetConfig shows the latest numeric value on a RADIAL or LINEAR
+// scale from Min to Max.
+type GaugeWidgetConfig struct {
+	Topic string
+	QoS byte
+	ValuePath string
+	Transform string
+	Variant string
+	Min float64
+	Max float64
+	Unit string
+	Precision int // decimals shown
+	Thresholds []GaugeThreshold // sorted by value
+	StaleAfter int // seconds without a message, 0 never marks the value stale
+}
+
+// SliderWidgetConfig publishes the chosen value to Topic in PayloadTemplate,
+// the optional StateTopic reflects the value confirmed by the device.
+type SliderWidgetConfig struct {
+	Topic string
+	QoS byte
+	Retain bool
+	Min float64
+	Max float64
+	Step float64
+	Unit string
+	PayloadTemplate string // {{value}} is replaced by the value
+	StateTopic string
+	ValuePath string // applied to the state
+	Transform string
+	Debounce int // milliseconds between publishes while dragging
+	PublishProperties
+}
+
+// SwitchWidgetConfig publishes PayloadOn or PayloadOff to Topic and shows
+// the state confirmed on StateTopic. StateOn and StateOff are values or
+// conditions, see indicatorState.
+type SwitchWidgetConfig struct {
 	Topic string
+	QoS byte
+	Retain bool
+	PayloadOn string
+	PayloadOff string
+	StateTopic string
+	ValuePath string // applied to the state
+	Transform string
+	StateOn string
+	StateOff string // empty means every value that is not ON
+	Timeout int // seconds a command stays pending
+	PublishProperties
+}
+
+// InputWidgetConfig renders a form of Fields on the dashboard and publishes
+// the validated values to Topic, see InputWidgetConfig.Payload.
+type InputWidgetConfig struct {
+	Topic string
+	QoS byte
+	Retain bool
+	Format string // PLAIN or JSON
+	Fields []InputField
+	PublishProperties
+}
+
+// ChartSeries is a line of a chart, a topic filter draws one line per
+// matching topic.
+type ChartSeries struct {
+	Topic string
+	ValuePath string
+	Transform string
 	Label string
-	MaxLength int
+	Color string
+	Axis string // LEFT or RIGHT
+}
+
+type TimeseriesLineChartWidgetConfig struct {
+	QoS byte
+	Series []ChartSeries
+	MaxLength int // values per line without a window
+	Window int // seconds of history shown, 0 shows the last MaxLength values
+	// the single series of older charts, moved into Series by migrate
+	Topic string `json:",omitempty"`
+	ValuePath string `json:",omitempty"`
+	Transform string `json:",omitempty"`
+	Label string `json:",omitempty"`
 }
 
 type TimeseriesLineChartCreate struct {
@@ -75,11 +252,20 @@ type TimeseriesLineChartCreate struct {
 type WidgetData struct {
 	ID int
 	Data any
+	Error string `json:",omitempty"`
 }
 
+// Datasets share the timestamps, values of the other datasets are nil at the
+// timestamp of a value.
 type TimeseriesLineChartWidgetData struct {
-	Timeseries []string
-	Datasets map[string][]any
+	Timestamps []int64 // unix milliseconds
+	Datasets []ChartDataset
+}
+
+type TableWidgetRow struct {
+	Topic string
+	Payload string
+	ReceivedAt time.Time
 }
 
 func createProjectsTable(db *sql.DB) {
@@ -91,7 +277,31 @@ func createProjectsTable(db *sql.DB) {
 		broker_client_id TEXT NOT NULL,
 		broker_address TEXT NOT NULL,
 		broker_port INTEGER NOT NULL,
-		broker_protocol TEXT NOT NULL
+		broker_protocol TEXT NOT NULL,
+		broker_protocol_version INTEGER NOT NULL DEFAULT 4,
+		broker_username TEXT NOT NULL DEFAULT '',
+		broker_password TEXT NOT NULL DEFAULT '',
+		tls_ca_cert BLOB,
+		tls_client_cert BLOB,
+		tls_client_key TEXT NOT NULL DEFAULT '',
+		tls_server_name TEXT NOT NULL DEFAULT '',
+		tls_insecure_skip_verify INTEGER NOT NULL DEFAULT 0,
+		broker_ws_path TEXT NOT NULL DEFAULT '/mqtt',
+		broker_ws_headers TEXT NOT NULL DEFAULT '',
+		buffer_depth INTEGER NOT NULL DEFAULT 100,
+		buffer_max_bytes INTEGER NOT NULL DEFAULT 0,
+		will_topic TEXT NOT NULL DEFAULT '',
+		will_payload TEXT NOT NULL DEFAULT '',
+		will_qos INTEGER NOT NULL DEFAULT 0,
+		will_retain INTEGER NOT NULL DEFAULT 0,
+		birth_topic TEXT NOT NULL DEFAULT '',
+		birth_payload TEXT NOT NULL DEFAULT '',
+		birth_qos INTEGER NOT NULL DEFAULT 0,
+		birth_retain INTEGER NOT NULL DEFAULT 0,
+		explorer_filter TEXT NOT NULL DEFAULT '#',
+		payload_decoders TEXT NOT NULL DEFAULT '',
+		proto_descriptor_set BLOB,
+		sparkplug_enabled INTEGER NOT NULL DEFAULT 0
 	);`)
 	if err != nil {
 		log.Fatalln("Unable to create projects table", err.Error())
@@ -102,6 +312,138 @@ func createProjectsTable(db *sql.DB) {
 	createProjectWidgetsTable(db)
 }
 
+// Brings projects tables of older databases up to date.
+func migrateProjectsTable(db *sql.DB) {
+	addColumnIfNotExists(db, "projects", "broker_username", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "projects", "broker_protocol_version", "INTEGER NOT NULL DEFAULT 4")
+	addColumnIfNotExists(db, "projects", "broker_password", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "projects", "tls_ca_cert", "BLOB")
+	addColumnIfNotExists(db, "projects", "tls_client_cert", "BLOB")
+	addColumnIfNotExists(db, "projects", "tls_client_key", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "projects", "tls_server_name", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "projects", "tls_insecure_skip_verify", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "projects", "broker_ws_path", "TEXT NOT NULL DEFAULT '/mqtt'")
+	addColumnIfNotExists(db, "projects", "broker_ws_headers", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "projects", "buffer_depth", "INTEGER NOT NULL DEFAULT 100")
+	addColumnIfNotExists(db, "projects", "buffer_max_bytes", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "projects", "will_topic", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "projects", "will_payload", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "projects", "will_qos", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "projects", "will_retain", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "projects", "birth_topic", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "projects", "birth_payload", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "projects", "birth_qos", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "projects", "birth_retain", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "projects", "explorer_filter", "TEXT NOT NULL DEFAULT '#'")
+	addColumnIfNotExists(db, "projects", "payload_decoders", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "projects", "proto_descriptor_set", "BLOB")
+	addColumnIfNotExists(db, "projects", "sparkplug_enabled", "INTEGER NOT NULL DEFAULT 0")
+
+	// TLS brokers were saved as tls or mqtts before the protocol became the
+	// scheme of the broker URL
+	_, err := db.Exec("UPDATE projects SET broker_protocol = ? WHERE broker_protocol IN ('tls', 'mqtts')", BrokerProtocolSSL)
+	if err != nil {
+		log.Fatalln("Unable to migrate broker protocols", err.Error())
+	}
+}
+
+func GetProjectBySlug(db *sql.DB, slug string) (*Project, error) {
+	var project Project
+	var brokerPassword string
+	var tlsClientKey string
+	err := db.QueryRow("SELECT id, team_id, name, slug, broker_client_id, broker_address, broker_port, broker_protocol, broker_protocol_version, broker_username, broker_password, tls_ca_cert, tls_client_cert, tls_client_key, tls_server_name, tls_insecure_skip_verify, broker_ws_path, broker_ws_headers, buffer_depth, buffer_max_bytes, will_topic, will_payload, will_qos, will_retain, birth_topic, birth_payload, birth_qos, birth_retain, explorer_filter, payload_decoders, proto_descriptor_set, sparkplug_enabled FROM projects WHERE slug = ?", slug).Scan(&project.ID, &project.TeamID, &project.Name, &project.Slug, &project.BrokerClientID, &project.BrokerAddress, &project.BrokerPort, &project.BrokerProtocol, &project.BrokerProtocolVersion, &project.BrokerUsername, &brokerPassword, &project.TLSCACert, &project.TLSClientCert, &tlsClientKey, &project.TLSServerName, &project.TLSInsecureSkipVerify, &project.BrokerWebSocketPath, &project.BrokerWebSocketHeaders, &project.BufferDepth, &project.BufferMaxBytes, &project.WillTopic, &project.WillPayload, &project.WillQoS, &project.WillRetain, &project.BirthTopic, &project.BirthPayload, &project.BirthQoS, &project.BirthRetain, &project.ExplorerFilter, &project.PayloadDecoders, &project.ProtoDescriptorSet, &project.SparkplugEnabled)
+	if err != nil {
+		return nil, err
+	}
+
+	// secrets encrypted with another key are left empty, so they can be
+	// entered again in the settings
+	project.BrokerPassword, err = DecryptSecret(brokerPassword)
+	if err != nil {
+		log.Println("Unable to decrypt the broker password of project", project.Slug, err)
+	}
+
+	clientKey, err := DecryptSecret(tlsClientKey)
+	if err != nil {
+		log.Println("Unable to decrypt the TLS client key of project", project.Slug, err)
+		project.TLSClientKeyLost = true
+	}
+	project.TLSClientKey = []byte(clientKey)
+
+	return &project, nil
+}
+
+// Returns the broker URL in the form paho expects, e.g. ssl://host:8883 or
+// wss://host:443/mqtt
+func (p *Project) BrokerURL() string {
+	protocol := p.BrokerProtocol
+	if protocol == "" {
+		protocol = BrokerProtocolTCP
+	}
+
+	url := fmt.Sprintf("%s://%s:%d", protocol, p.BrokerAddress, p.BrokerPort)
+
+	if p.BrokerProtocol == BrokerProtocolWS || p.BrokerProtocol == BrokerProtocolWSS {
+		path := p.BrokerWebSocketPath
+		if path != "" && !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		url += path
+	}
+
+	return url
+}
+
+// Parses the WebSocket upgrade headers, one "Name: value" pair per line.
+func parseBrokerHeaders(text string) (http.Header, error) {
+	headers := http.Header{}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected \"Name: value\"", line)
+		}
+
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	return headers, nil
+}
+
+func validateBrokerSettings(protocol string, address string, port string, headers string) error {
+	if !slices.Contains(brokerProtocols, protocol) {
+		return fmt.Errorf("unsupported broker protocol %q, expected one of %s", protocol, strings.Join(brokerProtocols, ", "))
+	}
+
+	if address == "" {
+		return errors.New("broker address is required")
+	}
+
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 1 || portNumber > 65535 {
+		return fmt.Errorf("invalid broker port %q", port)
+	}
+
+	if _, err := parseBrokerHeaders(headers); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Topics the client publishes to must not contain wildcards.
+func validatePublishTopic(topic string) error {
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("topic %q must not contain wildcards", topic)
+	}
+
+	return nil
+}
+
 func createProjectSectionsTable(db *sql.DB) {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS project_sections(
 		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
@@ -179,7 +521,7 @@ func projectViewHandler(db *sql.DB, localizer *i18n.Localizer, store *sessions.C
 		}
 
 		var project Project
-		err := db.QueryRow("SELECT id, name, slug FROM projects WHERE slug = ?", slugParameter).Scan(&project.ID, &project.Name, &project.Slug)
+		err := db.QueryRow("SELECT id, name, slug, sparkplug_enabled FROM projects WHERE slug = ?", slugParameter).Scan(&project.ID, &project.Name, &project.Slug, &project.SparkplugEnabled)
 		if err != nil {
 			http.NotFound(w, req)
 			return
@@ -219,17 +561,12 @@ func projectViewHandler(db *sql.DB, localizer *i18n.Localizer, store *sessions.C
 				}
 
 				// parse config
-				var config any
-				if projectWidget.Config != nil && len(projectWidget.Config) > 0 {
-					err = json.Unmarshal(projectWidget.Config, &config)
-					if err != nil {
-						log.Fatal(err)
-						return
-					}
+				projectWidget.ConfigParsed, err = parseWidgetConfig(projectWidget.Widget, projectWidget.Config)
+				if err != nil {
+					log.Fatal(err)
+					return
 				}
 
-				projectWidget.ConfigParsed = config
-
 				projectWidgets = append(projectWidgets, projectWidget)
 			}
 
@@ -251,6 +588,8 @@ func projectViewHandler(db *sql.DB, localizer *i18n.Localizer, store *sessions.C
 			"delete": localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "delete"}),
 			"connect": localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "connect"}),
 			"disconnect": localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "disconnect"}),
+			"connecting": localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "connecting"}),
+			"reconnecting": localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "reconnecting"}),
 			"no_data": localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "no_data"}),
 		}
 
@@ -345,7 +684,7 @@ func adminNewProjectHandler(db *sql.DB, store *sessions.CookieStore) http.Handle
 
 		if req.Method == "GET" {
 			tmpl := template.Must(template.ParseFiles("./views/admin/layout.html", "./views/admin/new-project.html"))
-			tmpl.Execute(w, "")
+			tmpl.Execute(w, brokerProtocols)
 		} else if req.Method == "POST" {
 			if err := req.ParseForm(); err != nil {
 				fmt.Fprintf(w, "ERROR: %v", err)
@@ -358,6 +697,20 @@ func adminNewProjectHandler(db *sql.DB, store *sessions.CookieStore) http.Handle
 			brokerAddress := req.FormValue("broker-address")
 			brokerPort := req.FormValue("broker-port")
 			brokerProtocol := req.FormValue("broker-protocol")
+			brokerUsername := req.FormValue("broker-username")
+			brokerWebSocketPath := req.FormValue("broker-ws-path")
+			brokerWebSocketHeaders := req.FormValue("broker-ws-headers")
+
+			if err := validateBrokerSettings(brokerProtocol, brokerAddress, brokerPort, brokerWebSocketHeaders); err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+
+			brokerPassword, err := EncryptSecret(req.FormValue("broker-password"))
+			if err != nil {
+				log.Fatal(err)
+				return
+			}
 
 			// TODO: Get team id of the user
 			teamUser, err := GetTeamUserByUserID(db, session.Values["user_id"].(int))
@@ -366,13 +719,13 @@ func adminNewProjectHandler(db *sql.DB, store *sessions.CookieStore) http.Handle
 				return
 			}
 
-			stmt, err := db.Prepare("INSERT INTO projects(team_id,name,slug,broker_client_id,broker_address,broker_port,broker_protocol) VALUES(?,?,?,?,?,?,?)")
+			stmt, err := db.Prepare("INSERT INTO projects(team_id,name,slug,broker_client_id,broker_address,broker_port,broker_protocol,broker_username,broker_password,broker_ws_path,broker_ws_headers) VALUES(?,?,?,?,?,?,?,?,?,?,?)")
 			if err != nil {
 				log.Fatal(err)
 				return
 			}
 
-			res, err := stmt.Exec(teamUser.TeamID, name, slug, brokerClientID, brokerAddress, brokerPort, brokerProtocol)
+			res, err := stmt.Exec(teamUser.TeamID, name, slug, brokerClientID, brokerAddress, brokerPort, brokerProtocol, brokerUsername, brokerPassword, brokerWebSocketPath, brokerWebSocketHeaders)
 			if err != nil {
 				log.Fatal(err)
 				return
@@ -437,7 +790,7 @@ func projectNewSectionHandler(db *sql.DB, store *sessions.CookieStore) http.Hand
 	}
 }
 
-func projectNewWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.HandlerFunc {
+func projectNewWidgetHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			fmt.Fprint(w, "Only POST method is supported.")
@@ -478,13 +831,44 @@ func projectNewWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.Handl
 			return
 		}
 
+		qos, err := parseQoS(r.FormValue("qos"))
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+		retain := r.FormValue("retain") == "on"
+
+		if err := validateWidgetTopic(widget, topic); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		valuePath := r.FormValue("value-path")
+		if _, err := parseValuePath(valuePath); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		transform := r.FormValue("transform")
+		if _, err := compileExpression(transform); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		publishProperties, err := parsePublishProperties(r)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
 		stmt, err := db.Prepare("INSERT INTO project_widgets(project_section_id, widget, title, config) VALUES(?,?,?,?)")
 		if err != nil {
 			log.Fatal(err)
 			return
 		}
 
-		var config any
+		var widgetConfig any
+		var topics []string // subscribed to once the widget is saved
 
 		if widget == "TEXT" {
 			if topic == "" {
@@ -492,9 +876,12 @@ func projectNewWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.Handl
 				return
 			}
 
-			config, err = json.Marshal(TextWidgetConfig{
+			widgetConfig = TextWidgetConfig{
 				Topic: topic,
-			})
+				QoS: qos,
+				ValuePath: valuePath,
+				Transform: transform,
+			}
 		} else if widget == "BUTTON" {
 			message := r.FormValue("message")
 			if topic == "" {
@@ -506,10 +893,13 @@ func projectNewWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.Handl
 				return
 			}
 
-			config, err = json.Marshal(ButtonWidgetConfig{
+			widgetConfig = ButtonWidgetConfig{
 				Topic: topic,
+				QoS: qos,
+				Retain: retain,
 				Message: message,
-			})
+				PublishProperties: publishProperties,
+			}
 		} else if widget == "INDICATOR" {
 			onCondition := r.FormValue("on-condition")
 			if topic == "" {
@@ -522,19 +912,153 @@ func projectNewWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.Handl
 				return
 			}
 
-			config, err = json.Marshal(IndicatorWidgetConfig{
+			widgetConfig = IndicatorWidgetConfig{
 				Topic: topic,
+				QoS: qos,
+				ValuePath: valuePath,
+				Transform: transform,
 				OnCondition: onCondition,
 				Color: "blue",
-			})
-		} else if widget == "TIMESERIES-LINE-CHART" {
-			label := r.FormValue("label")
+			}
+		} else if widget == "REQUEST" {
+			responseTopic := r.FormValue("response-topic")
+			timeout, err := strconv.Atoi(r.FormValue("timeout"))
+			if err != nil || timeout < 1 {
+				fmt.Fprintf(w, "ERROR: timeout must be at least 1 second")
+				return
+			}
+			if topic == "" || responseTopic == "" {
+				http.Redirect(w, r, "/projects/" + slug, http.StatusFound)
+				return
+			}
+			if err := validatePublishTopic(responseTopic); err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
 
-			config, err = json.Marshal(TimeseriesLineChartWidgetConfig{
+			widgetConfig = RequestWidgetConfig{
 				Topic: topic,
-				Label: label,
-				MaxLength: 8, // TODO: make this changable
-			})
+				QoS: qos,
+				Payload: r.FormValue("payload"),
+				ResponseTopic: responseTopic,
+				CorrelationField: r.FormValue("correlation-field"),
+				Timeout: timeout,
+				ValuePath: valuePath,
+				Transform: transform,
+				PublishProperties: publishProperties,
+			}
+
+			// replies arrive on the response topic, the request topic is never read
+			topic = responseTopic
+		} else if widget == "TABLE" {
+			if topic == "" {
+				http.Redirect(w, r, "/projects/" + slug, http.StatusFound)
+				return
+			}
+
+			widgetConfig = TableWidgetConfig{
+				Topic: topic,
+				QoS: qos,
+				ValuePath: valuePath,
+				Transform: transform,
+			}
+		} else if widget == "GAUGE" {
+			if topic == "" {
+				http.Redirect(w, r, "/projects/" + slug, http.StatusFound)
+				return
+			}
+
+			gaugeConfig, err := parseGaugeForm(r)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+			gaugeConfig.Topic = topic
+			gaugeConfig.QoS = qos
+			gaugeConfig.ValuePath = valuePath
+			gaugeConfig.Transform = transform
+
+			widgetConfig = gaugeConfig
+		} else if widget == "SLIDER" {
+			if topic == "" {
+				http.Redirect(w, r, "/projects/" + slug, http.StatusFound)
+				return
+			}
+
+			sliderConfig, err := parseSliderForm(r)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+			sliderConfig.Topic = topic
+			sliderConfig.QoS = qos
+			sliderConfig.Retain = retain
+			sliderConfig.PublishProperties = publishProperties
+			sliderConfig.ValuePath = valuePath
+			sliderConfig.Transform = transform
+
+			widgetConfig = sliderConfig
+
+			// the slider only reads the state topic
+			topic = sliderConfig.StateTopic
+		} else if widget == "SWITCH" {
+			if topic == "" {
+				http.Redirect(w, r, "/projects/" + slug, http.StatusFound)
+				return
+			}
+
+			switchConfig, err := parseSwitchForm(r)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+			switchConfig.Topic = topic
+			switchConfig.QoS = qos
+			switchConfig.Retain = retain
+			switchConfig.PublishProperties = publishProperties
+			switchConfig.ValuePath = valuePath
+			switchConfig.Transform = transform
+
+			widgetConfig = switchConfig
+
+			// the switch only reads the state topic
+			topic = switchConfig.StateTopic
+		} else if widget == "INPUT" {
+			if topic == "" {
+				http.Redirect(w, r, "/projects/" + slug, http.StatusFound)
+				return
+			}
+
+			inputConfig, err := parseInputForm(r)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+			inputConfig.Topic = topic
+			inputConfig.QoS = qos
+			inputConfig.Retain = retain
+			inputConfig.PublishProperties = publishProperties
+
+			widgetConfig = inputConfig
+		} else if widget == "TIMESERIES-LINE-CHART" {
+			chartConfig, err := parseChartForm(r)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+			chartConfig.QoS = qos
+
+			widgetConfig = chartConfig
+			topics = chartConfig.Topics()
+		} else {
+			fmt.Fprintf(w, "ERROR: unknown widget %q", widget)
+			return
+		}
+
+		config, err := json.Marshal(widgetConfig)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
 		}
 
 		res, err := stmt.Exec(id, widget, title, config)
@@ -549,11 +1073,28 @@ func projectNewWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.Handl
 			return
 		}
 
+		if topics == nil && widget != "BUTTON" && widget != "INPUT" {
+			topics = []string{topic}
+		}
+
+		project, err := GetProjectBySlug(db, slug)
+		if err == nil {
+			for _, topic := range topics {
+				if topic == "" {
+					continue
+				}
+				if err := connections.Subscribe(project.ID, topic, qos); err != nil {
+					fmt.Fprintf(w, "ERROR: %v", err)
+					return
+				}
+			}
+		}
+
 		http.Redirect(w, r, "/projects/" + slug, http.StatusFound)
 	}
 }
 
-func projectConnectHandler(db *sql.DB, connections *[]*Connection, store *sessions.CookieStore) http.HandlerFunc {
+func projectConnectHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		session, _ := store.Get(r, "mqtt-studio-session")
 
@@ -564,131 +1105,33 @@ func projectConnectHandler(db *sql.DB, connections *[]*Connection, store *sessio
 
 		slugParameter := r.PathValue("slug")
 
-		var project Project
-		err := db.QueryRow("SELECT id, name, slug, broker_address, broker_port, broker_protocol FROM projects WHERE slug = ?", slugParameter).Scan(&project.ID, &project.Name, &project.Slug, &project.BrokerAddress, &project.BrokerPort, &project.BrokerProtocol)
+		project, err := GetProjectBySlug(db, slugParameter)
 		if err != nil {
 			http.NotFound(w, r)
 			return
 		}
 
-		var connection *Connection
-
-		// find connection
-		connectionFound := false
-		for i := 0; i < len(*connections); i++ {
-			if (*connections)[i].ProjectID == project.ID {
-				connectionFound = true
-				connection = (*connections)[i]
-				break
-			}
-		}
-
-		if !connectionFound { // create one
-			connection = &Connection{
-				ProjectID: project.ID,
-				Status: 0,
-				Broker: fmt.Sprintf("tcp://%s:%d", project.BrokerAddress, project.BrokerPort),
-				ClientID: project.BrokerClientID,
-			}
-			*connections = append(*connections, connection)
-		}
-
-		if connection.Status == 0 {
-			// get widgets
-			rows, err := db.Query("SELECT id, name FROM project_sections WHERE project_id = ?", project.ID)
+		if connection := connections.Get(project.ID); connection == nil || connection.GetStatus() == ConnectionOffline {
+			projectWidgets, err := getProjectWidgets(db, project.ID)
 			if err != nil {
-				log.Fatal(err)
+				fmt.Fprintf(w, "ERROR: %v", err)
 				return
 			}
 
-			var topics []string
-
-			var projectSections []ProjectSection
-			for rows.Next() {
-				var projectSection ProjectSection
-
-				err = rows.Scan(&projectSection.ID, &projectSection.Name)
-				if err != nil {
-					fmt.Fprintf(w, err.Error())
-					continue
-				}
-
-				// Query the widgets that are related to this section
-				widgetRows, err := db.Query("SELECT id, widget, config FROM project_widgets WHERE project_section_id = ?", projectSection.ID)
-				if err != nil {
-					log.Fatal(err)
-					return
-				}
-
-				var projectWidgets []ProjectWidget
-				for widgetRows.Next() {
-					var projectWidget ProjectWidget
-
-					err = widgetRows.Scan(&projectWidget.ID, &projectWidget.Widget, &projectWidget.Config)
-					if err != nil {
-						fmt.Fprintf(w, err.Error())
-						continue
-					}
-
-					if projectWidget.Widget == "TEXT" {
-						var textWidgetConfig TextWidgetConfig
-						err = json.Unmarshal(projectWidget.Config, &textWidgetConfig)
-						if err != nil {
-							log.Fatal(err)
-							return
-						}
-
-						topics = append(topics, textWidgetConfig.Topic)
-					} else if projectWidget.Widget == "INDICATOR" {
-						var indicatorWidgetConfig IndicatorWidgetConfig
-						err = json.Unmarshal(projectWidget.Config, &indicatorWidgetConfig)
-						if err != nil {
-							log.Fatal(err)
-							return
-						}
-
-						topics = append(topics, indicatorWidgetConfig.Topic)
-					} else if projectWidget.Widget == "TIMESERIES-LINE-CHART" {
-						var config TimeseriesLineChartWidgetConfig
-						err = json.Unmarshal(projectWidget.Config, &config)
-						if err != nil {
-							log.Fatal(err)
-							return
-						}
-
-						topics = append(topics, config.Topic)
-					}
-
-					projectWidgets = append(projectWidgets, projectWidget)
-				}
-
-				widgetRows.Close()
-
-				projectSection.Widgets = projectWidgets
+			subscriptions := getProjectSubscriptions(projectWidgets)
 
-				projectSections = append(projectSections, projectSection)
+			err = connections.Connect(db, project, subscriptions)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
 			}
-
-			rows.Close()
-
-			go func() {
-				err = connection.Connect(db)
-				if err != nil {
-					log.Fatal(err)
-					return
-				}
-
-				for i := 0; i < len(topics); i++ {
-					go connection.Subscribe(topics[i])
-				}
-			}()
 		}
 
 		http.Redirect(w, r, "/projects/" + slugParameter, http.StatusFound)
 	}
 }
 
-func projectDisconnectHandler(db *sql.DB, connections *[]*Connection, store *sessions.CookieStore) http.HandlerFunc {
+func projectDisconnectHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		session, _ := store.Get(r, "mqtt-studio-session")
 
@@ -706,27 +1149,13 @@ func projectDisconnectHandler(db *sql.DB, connections *[]*Connection, store *ses
 			return
 		}
 
-		var connection *Connection
-
-		// find connection
-		connectionFound := false
-		for i := 0; i < len(*connections); i++ {
-			if (*connections)[i].ProjectID == project.ID {
-				connectionFound = true
-				connection = (*connections)[i]
-				break
-			}
-		}
-
-		if connectionFound && connection.Status == 1 {
-			go connection.Disconnect()
-		}
+		connections.Disconnect(db, project.ID)
 
 		http.Redirect(w, r, "/projects/" + slugParameter, http.StatusFound)
 	}
 }
 
-func projectConnectionHandler(db *sql.DB, connections *[]*Connection, store *sessions.CookieStore) http.HandlerFunc {
+func projectConnectionHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		session, _ := store.Get(r, "mqtt-studio-session")
 
@@ -744,32 +1173,11 @@ func projectConnectionHandler(db *sql.DB, connections *[]*Connection, store *ses
 			return
 		}
 
-		var connection *Connection
-
-		// find connection
-		connectionFound := false
-		for i := 0; i < len(*connections); i++ {
-			if (*connections)[i].ProjectID == project.ID {
-				connectionFound = true
-				connection = (*connections)[i]
-				break
-			}
-		}
-
-		if connectionFound {
-			if connection.Status == 1 {
-				fmt.Fprint(w, "online")
-			} else {
-				fmt.Fprint(w, "offline")
-			}
-			return
-		}
-
-		fmt.Fprintf(w, "offline")
+		fmt.Fprint(w, connections.StatusText(project.ID))
 	}
 }
 
-func projectDataHandler(db *sql.DB, connections *[]*Connection, store *sessions.CookieStore) http.HandlerFunc {
+func projectDataHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		session, _ := store.Get(r, "mqtt-studio-session")
 
@@ -780,27 +1188,17 @@ func projectDataHandler(db *sql.DB, connections *[]*Connection, store *sessions.
 
 		slugParameter := r.PathValue("slug")
 
-		var project Project
-		err := db.QueryRow("SELECT id, name, slug, broker_address, broker_port, broker_protocol FROM projects WHERE slug = ?", slugParameter).Scan(&project.ID, &project.Name, &project.Slug, &project.BrokerAddress, &project.BrokerPort, &project.BrokerProtocol)
+		project, err := GetProjectBySlug(db, slugParameter)
 		if err != nil {
 			http.NotFound(w, r)
 			return
 		}
 
-		// find connection
-		var connection *Connection
-		connectionFound := false
-		for i := 0; i < len(*connections); i++ {
-			if (*connections)[i].ProjectID == project.ID {
-				connectionFound = true
-				connection = (*connections)[i]
-				break
-			}
-		}
+		connection := connections.Get(project.ID)
 
 		w.Header().Set("Content-Type", "application/json")
 
-		if !connectionFound {
+		if connection == nil {
 			resp, err := json.Marshal(nil)
 			if err != nil {
 				log.Fatal(err)
@@ -810,180 +1208,65 @@ func projectDataHandler(db *sql.DB, connections *[]*Connection, store *sessions.
 			return
 		}
 
-		// get widgets and match topics
-		rows, err := db.Query("SELECT id FROM project_sections WHERE project_id = ?", project.ID)
+		projectWidgets, err := getProjectWidgets(db, project.ID)
 		if err != nil {
-			log.Fatal(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		var data []WidgetData
-
-		for rows.Next() {
-			var projectSection ProjectSection
-
-			err = rows.Scan(&projectSection.ID)
-			if err != nil {
-				fmt.Fprintf(w, err.Error())
-				continue
-			}
+		decoders, err := newPayloadDecoders(project)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-			// Query the widgets that are related to this section
-			widgetRows, err := db.Query("SELECT id, widget, config FROM project_widgets WHERE project_section_id = ?", projectSection.ID)
+		var data []WidgetData
+		for _, projectWidget := range projectWidgets {
+			widgetData, err := getWidgetData(db, connection, decoders, projectWidget)
 			if err != nil {
-				log.Fatal(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 
-			for widgetRows.Next() {
-				var projectWidget ProjectWidget
-
-				err = widgetRows.Scan(&projectWidget.ID, &projectWidget.Widget, &projectWidget.Config)
-				if err != nil {
-					fmt.Fprintf(w, err.Error())
-					continue
-				}
-
-				topic := ""
-
-				// check Config is not empty
-
-				if projectWidget.Widget == "TEXT" {
-					var textWidgetConfig TextWidgetConfig
-					err = json.Unmarshal(projectWidget.Config, &textWidgetConfig)
-					if err != nil {
-						log.Fatal(err)
-						return
-					}
-
-					topic = textWidgetConfig.Topic
-					if topic == "" {
-						data = append(data, WidgetData{
-							ID: projectWidget.ID,
-							Data: nil,
-						})
-						continue
-					}
-
-					if connection.DataBuffer[topic] == nil || len(connection.DataBuffer[topic]) <= 0 {
-						data = append(data, WidgetData{
-							ID: projectWidget.ID,
-							Data: nil,
-						})
-						continue
-					}
-
-					data = append(data, WidgetData{
-						ID: projectWidget.ID,
-						Data: string(connection.DataBuffer[topic][len(connection.DataBuffer[topic]) - 1]),
-					})
-
-					continue
-				} else if projectWidget.Widget == "INDICATOR" {
-					var indicatorWidgetConfig IndicatorWidgetConfig
-					err = json.Unmarshal(projectWidget.Config, &indicatorWidgetConfig)
-					if err != nil {
-						log.Fatal(err)
-						return
-					}
-
-					topic = indicatorWidgetConfig.Topic
-					if topic == "" {
-						data = append(data, WidgetData{
-							ID: projectWidget.ID,
-							Data: nil,
-						})
-						continue
-					}
-
-					if connection.DataBuffer[topic] == nil || len(connection.DataBuffer[topic]) <= 0 {
-						data = append(data, WidgetData{
-							ID: projectWidget.ID,
-							Data: nil,
-						})
-						continue
-					}
-
-					data = append(data, WidgetData{
-						ID: projectWidget.ID,
-						Data: string(connection.DataBuffer[topic][len(connection.DataBuffer[topic]) - 1]),
-					})
-
-					continue
-				} else if projectWidget.Widget == "TIMESERIES-LINE-CHART" {
-					var config TimeseriesLineChartWidgetConfig
-					err = json.Unmarshal(projectWidget.Config, &config)
-					if err != nil {
-						log.Fatal(err)
-						return
-					}
-
-					widgetData := map[string][]any{}
-					timeSeries := []string{}
-					dataLogs, err := getTopicDataLogs(db, config.Topic, config.MaxLength)
-					if err != nil {
-						log.Fatal(err)
-						return
-					}
-
-					var datasets []any
-					for j := len(dataLogs) - 1; j >= 0; j-- {
-						datasets = append(datasets, string(dataLogs[j].Data))
-						if (len(timeSeries) < config.MaxLength) {
-							timeSeries = append(timeSeries, dataLogs[j].CreatedAt.Format("15:04:05"))
-						}
-					}
-
-					widgetData[config.Label] = datasets
-
-					data = append(data, WidgetData{
-						ID: projectWidget.ID,
-						Data: TimeseriesLineChartWidgetData{
-							Timeseries: timeSeries,
-							Datasets: widgetData,
-						},
-					})
-
-					continue
-				}
-
-				if topic == "" {
-					data = append(data, WidgetData{
-						ID: projectWidget.ID,
-						Data: nil,
-					})
-					continue
-				}
+			data = append(data, widgetData)
+		}
 
-				if connection.DataBuffer[topic] == nil || len(connection.DataBuffer[topic]) <= 0 {
-					data = append(data, WidgetData{
-						ID: projectWidget.ID,
-						Data: nil,
-					})
-					continue
-				}
+		resp, err := json.Marshal(data)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		w.Write(resp)
+	}
+}
 
-				data = append(data, WidgetData{
-					ID: projectWidget.ID,
-					Data: connection.DataBuffer[topic][0],
-				})
-			}
+func projectBufferHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
 
-			widgetRows.Close()
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
 		}
 
-		rows.Close()
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
 
-		resp, err := json.Marshal(data)
+		resp, err := json.Marshal(connections.BufferUsage(project.ID))
 		if err != nil {
 			log.Fatal(err)
 			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
 		w.Write(resp)
 	}
 }
 
-func projectSubmitValueHandler(db *sql.DB, connections *[]*Connection, store *sessions.CookieStore) http.HandlerFunc {
+func projectSubmitValueHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			fmt.Fprintf(w, "Only POST method is supported.")
@@ -1012,18 +1295,8 @@ func projectSubmitValueHandler(db *sql.DB, connections *[]*Connection, store *se
 			return
 		}
 
-		// find connection
-		var connection *Connection
-		connectionFound := false
-		for i := 0; i < len(*connections); i++ {
-			if (*connections)[i].ProjectID == project.ID {
-				connectionFound = true
-				connection = (*connections)[i]
-				break
-			}
-		}
-
-		if !connectionFound {
+		connection := connections.Get(project.ID)
+		if connection == nil {
 			http.Redirect(w, r, "/projects/" + slugParameter, http.StatusFound)
 			return
 		}
@@ -1036,23 +1309,22 @@ func projectSubmitValueHandler(db *sql.DB, connections *[]*Connection, store *se
 			return
 		}
 
-		// parse config
-		if projectWidget.Widget == "BUTTON" {
-			var config ButtonWidgetConfig
-			err = json.Unmarshal(projectWidget.Config, &config)
-			if err != nil {
-				log.Fatal(err)
-				return
-			}
+		projectWidget.ConfigParsed, err = parseWidgetConfig(projectWidget.Widget, projectWidget.Config)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
 
-			connection.SendMessage(config.Topic, string(config.Message))
+		if err := publishWidgetValue(connection, projectWidget, r.FormValue("value")); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
 		}
 
 		http.Redirect(w, r, "/projects/" + slugParameter, http.StatusFound)
 	}
 }
 
-func projectDeleteWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.HandlerFunc {
+func projectDeleteWidgetHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			fmt.Fprintf(w, "Only POST method is supported.")
@@ -1081,6 +1353,19 @@ func projectDeleteWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.Ha
 			return
 		}
 
+		projectWidgets, err := getProjectWidgets(db, project.ID)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		var topics []string
+		for _, projectWidget := range projectWidgets {
+			if strconv.Itoa(projectWidget.ID) == id {
+				topics = getWidgetTopics(projectWidget)
+			}
+		}
+
 		stmt, err := db.Prepare("DELETE FROM project_widgets WHERE id = ?")
 		if err != nil {
 			log.Fatal(err)
@@ -1093,11 +1378,16 @@ func projectDeleteWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.Ha
 			return
 		}
 
+		if err := unsubscribeUnusedTopics(db, connections, project.ID, topics); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
 		http.Redirect(w, r, "/projects/" + slugParameter, http.StatusFound)
 	}
 }
 
-func projectEditWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.HandlerFunc {
+func projectEditWidgetHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			fmt.Fprintf(w, "Only POST method is supported.")
@@ -1134,40 +1424,183 @@ func projectEditWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.Hand
 			return
 		}
 
-		var config any
+		// topics of the saved config, unsubscribed below unless still in use
+		projectWidget.ConfigParsed, err = parseWidgetConfig(projectWidget.Widget, projectWidget.Config)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+		previousTopics := getWidgetTopics(projectWidget)
+
+		qos, err := parseQoS(r.FormValue("qos"))
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+		retain := r.FormValue("retain") == "on"
+
+		if err := validateWidgetTopic(projectWidget.Widget, r.FormValue("topic")); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		valuePath := r.FormValue("value-path")
+		if _, err := parseValuePath(valuePath); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		transform := r.FormValue("transform")
+		if _, err := compileExpression(transform); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		publishProperties, err := parsePublishProperties(r)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		var widgetConfig any
+		var topics []string // subscribed to once the widget is saved
 		if projectWidget.Widget == "TEXT" {
 			topic := r.FormValue("topic")
 
-			config, err = json.Marshal(TextWidgetConfig{
+			widgetConfig = TextWidgetConfig{
 				Topic: topic,
-			})
+				QoS: qos,
+				ValuePath: valuePath,
+				Transform: transform,
+			}
 		} else if projectWidget.Widget == "BUTTON" {
 			topic := r.FormValue("topic")
 			message := r.FormValue("message")
 
-			config, err = json.Marshal(ButtonWidgetConfig{
+			widgetConfig = ButtonWidgetConfig{
 				Topic: topic,
+				QoS: qos,
+				Retain: retain,
 				Message: message,
-			})
+				PublishProperties: publishProperties,
+			}
 		} else if projectWidget.Widget == "INDICATOR" {
 			topic := r.FormValue("topic")
 			onCondition := r.FormValue("on-condition")
 			color := r.FormValue("color")
 
-			config, err = json.Marshal(IndicatorWidgetConfig{
+			widgetConfig = IndicatorWidgetConfig{
 				Topic: topic,
+				QoS: qos,
+				ValuePath: valuePath,
+				Transform: transform,
 				OnCondition: onCondition,
 				Color: color,
-			})
-		} else if projectWidget.Widget == "TIMESERIES-LINE-CHART" {
+			}
+		} else if projectWidget.Widget == "REQUEST" {
 			topic := r.FormValue("topic")
-			label := r.FormValue("label")
+			responseTopic := r.FormValue("response-topic")
+			timeout, err := strconv.Atoi(r.FormValue("timeout"))
+			if err != nil || timeout < 1 {
+				fmt.Fprintf(w, "ERROR: timeout must be at least 1 second")
+				return
+			}
+			if err := validatePublishTopic(responseTopic); err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
 
-			config, err = json.Marshal(TimeseriesLineChartWidgetConfig{
+			widgetConfig = RequestWidgetConfig{
 				Topic: topic,
-				Label: label,
-				MaxLength: 8, // TODO: Make this changable
-			})
+				QoS: qos,
+				Payload: r.FormValue("payload"),
+				ResponseTopic: responseTopic,
+				CorrelationField: r.FormValue("correlation-field"),
+				Timeout: timeout,
+				ValuePath: valuePath,
+				Transform: transform,
+				PublishProperties: publishProperties,
+			}
+		} else if projectWidget.Widget == "TABLE" {
+			topic := r.FormValue("topic")
+
+			widgetConfig = TableWidgetConfig{
+				Topic: topic,
+				QoS: qos,
+				ValuePath: valuePath,
+				Transform: transform,
+			}
+		} else if projectWidget.Widget == "GAUGE" {
+			gaugeConfig, err := parseGaugeForm(r)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+			gaugeConfig.Topic = r.FormValue("topic")
+			gaugeConfig.QoS = qos
+			gaugeConfig.ValuePath = valuePath
+			gaugeConfig.Transform = transform
+
+			widgetConfig = gaugeConfig
+		} else if projectWidget.Widget == "SLIDER" {
+			sliderConfig, err := parseSliderForm(r)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+			sliderConfig.Topic = r.FormValue("topic")
+			sliderConfig.QoS = qos
+			sliderConfig.Retain = retain
+			sliderConfig.PublishProperties = publishProperties
+			sliderConfig.ValuePath = valuePath
+			sliderConfig.Transform = transform
+
+			widgetConfig = sliderConfig
+		} else if projectWidget.Widget == "SWITCH" {
+			switchConfig, err := parseSwitchForm(r)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+			switchConfig.Topic = r.FormValue("topic")
+			switchConfig.QoS = qos
+			switchConfig.Retain = retain
+			switchConfig.PublishProperties = publishProperties
+			switchConfig.ValuePath = valuePath
+			switchConfig.Transform = transform
+
+			widgetConfig = switchConfig
+		} else if projectWidget.Widget == "INPUT" {
+			inputConfig, err := parseInputForm(r)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+			inputConfig.Topic = r.FormValue("topic")
+			inputConfig.QoS = qos
+			inputConfig.Retain = retain
+			inputConfig.PublishProperties = publishProperties
+
+			widgetConfig = inputConfig
+		} else if projectWidget.Widget == "TIMESERIES-LINE-CHART" {
+			chartConfig, err := parseChartForm(r)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+			chartConfig.QoS = qos
+
+			widgetConfig = chartConfig
+			topics = chartConfig.Topics()
+		} else {
+			fmt.Fprintf(w, "ERROR: unknown widget %q", projectWidget.Widget)
+			return
+		}
+
+		config, err := json.Marshal(widgetConfig)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
 		}
 
 		stmt, err := db.Prepare("UPDATE project_widgets set title = ?, config = ? where id = ?")
@@ -1182,11 +1615,38 @@ func projectEditWidgetHandler(db *sql.DB, store *sessions.CookieStore) http.Hand
 			return
 		}
 
+		topic := r.FormValue("topic")
+		if projectWidget.Widget == "REQUEST" {
+			topic = r.FormValue("response-topic")
+		}
+		if projectWidget.Widget == "SLIDER" || projectWidget.Widget == "SWITCH" {
+			topic = r.FormValue("state-topic")
+		}
+
+		if topics == nil && projectWidget.Widget != "BUTTON" && projectWidget.Widget != "INPUT" {
+			topics = []string{topic}
+		}
+
+		for _, topic := range topics {
+			if topic == "" {
+				continue
+			}
+			if err := connections.Subscribe(project.ID, topic, qos); err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+		}
+
+		if err := unsubscribeUnusedTopics(db, connections, project.ID, previousTopics); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
 		http.Redirect(w, r, "/projects/" + slugParameter, http.StatusFound)
 	}
 }
 
-func projectDeleteSectionHandler(db *sql.DB, store *sessions.CookieStore) http.HandlerFunc {
+func projectDeleteSectionHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			fmt.Fprintf(w, "Only POST method is supported.")
@@ -1215,6 +1675,19 @@ func projectDeleteSectionHandler(db *sql.DB, store *sessions.CookieStore) http.H
 			return
 		}
 
+		projectWidgets, err := getProjectWidgets(db, project.ID)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		var topics []string
+		for _, projectWidget := range projectWidgets {
+			if strconv.Itoa(projectWidget.ProjectSectionID) == id {
+				topics = append(topics, getWidgetTopics(projectWidget)...)
+			}
+		}
+
 		// remove related widgets
 		stmt, err := db.Prepare("DELETE FROM project_widgets WHERE project_section_id = ?")
 		if err != nil {
@@ -1241,6 +1714,11 @@ func projectDeleteSectionHandler(db *sql.DB, store *sessions.CookieStore) http.H
 			return
 		}
 
+		if err := unsubscribeUnusedTopics(db, connections, project.ID, topics); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
 		http.Redirect(w, r, "/projects/" + slugParameter, http.StatusFound)
 	}
 }
@@ -1303,8 +1781,7 @@ func projectSettingsViewHandler(db *sql.DB, store *sessions.CookieStore) http.Ha
 
 		slugParameter := r.PathValue("slug")
 
-		var project Project
-		err := db.QueryRow("SELECT id, name, slug, broker_client_id, broker_address, broker_port, broker_protocol FROM projects WHERE slug = ?", slugParameter).Scan(&project.ID, &project.Name, &project.Slug, &project.BrokerClientID, &project.BrokerAddress, &project.BrokerPort, &project.BrokerProtocol)
+		project, err := GetProjectBySlug(db, slugParameter)
 		if err != nil {
 			http.NotFound(w, r)
 			return
@@ -1312,9 +1789,13 @@ func projectSettingsViewHandler(db *sql.DB, store *sessions.CookieStore) http.Ha
 
 		if r.Method == "GET" {
 			tmpl := template.Must(template.ParseFiles("./views/layout.html", "./views/project-settings.html"))
-			tmpl.Execute(w, project)
+			tmpl.Execute(w, ProjectSettingsViewData{
+				Project: project,
+				BrokerProtocols: brokerProtocols,
+				PayloadDecoders: payloadDecoderNames(),
+			})
 		} else if r.Method == "POST" {
-			if err := r.ParseForm(); err != nil {
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
 				fmt.Fprintf(w, "ERROR: %v", err)
 				return
 			}
@@ -1324,16 +1805,135 @@ func projectSettingsViewHandler(db *sql.DB, store *sessions.CookieStore) http.Ha
 			brokerAddress := r.FormValue("broker-address")
 			brokerPort := r.FormValue("broker-port")
 			brokerProtocol := r.FormValue("broker-protocol")
+			brokerUsername := r.FormValue("broker-username")
 
-			// TODO: validate form values
+			brokerProtocolVersion, err := strconv.Atoi(r.FormValue("broker-protocol-version"))
+			if err != nil || !slices.Contains(mqttVersions, brokerProtocolVersion) {
+				fmt.Fprintf(w, "ERROR: unsupported MQTT version %q", r.FormValue("broker-protocol-version"))
+				return
+			}
+			brokerWebSocketPath := r.FormValue("broker-ws-path")
+			brokerWebSocketHeaders := r.FormValue("broker-ws-headers")
+
+			if err := validateBrokerSettings(brokerProtocol, brokerAddress, brokerPort, brokerWebSocketHeaders); err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+
+			bufferDepth, err := strconv.Atoi(r.FormValue("buffer-depth"))
+			if err != nil || bufferDepth < 1 {
+				fmt.Fprintf(w, "ERROR: buffer depth must be a positive number")
+				return
+			}
+
+			bufferMaxBytes, err := strconv.Atoi(r.FormValue("buffer-max-bytes"))
+			if err != nil || bufferMaxBytes < 0 {
+				fmt.Fprintf(w, "ERROR: buffer max bytes must be zero or a positive number")
+				return
+			}
+
+			// empty password field keeps the stored one
+			brokerPassword := project.BrokerPassword
+			if r.FormValue("broker-password") != "" {
+				brokerPassword = r.FormValue("broker-password")
+			}
+			if r.FormValue("broker-password-clear") == "on" {
+				brokerPassword = ""
+			}
+
+			encryptedBrokerPassword, err := EncryptSecret(brokerPassword)
+			if err != nil {
+				log.Fatal(err)
+				return
+			}
+
+			// uploaded files replace the stored ones, empty fields keep them
+			uploadedFiles := map[string]*[]byte{
+				"tls-ca-cert": &project.TLSCACert,
+				"tls-client-cert": &project.TLSClientCert,
+				"tls-client-key": &project.TLSClientKey,
+				"proto-descriptor-set": &project.ProtoDescriptorSet,
+			}
+			for field, value := range uploadedFiles {
+				data, err := readUploadedFile(r, field)
+				if err != nil {
+					fmt.Fprintf(w, "ERROR: %v", err)
+					return
+				}
+
+				if data != nil {
+					*value = data
+				}
+
+				if r.FormValue(field + "-clear") == "on" {
+					*value = nil
+				}
+			}
+
+			project.WillTopic = r.FormValue("will-topic")
+			project.WillPayload = r.FormValue("will-payload")
+			project.WillRetain = r.FormValue("will-retain") == "on"
+			project.BirthTopic = r.FormValue("birth-topic")
+			project.BirthPayload = r.FormValue("birth-payload")
+			project.BirthRetain = r.FormValue("birth-retain") == "on"
+
+			for _, topic := range []string{project.WillTopic, project.BirthTopic} {
+				if err := validatePublishTopic(topic); err != nil {
+					fmt.Fprintf(w, "ERROR: %v", err)
+					return
+				}
+			}
+
+			project.WillQoS, err = parseQoS(r.FormValue("will-qos"))
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+
+			project.BirthQoS, err = parseQoS(r.FormValue("birth-qos"))
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+
+			project.ExplorerFilter = r.FormValue("explorer-filter")
+			if project.ExplorerFilter == "" {
+				project.ExplorerFilter = "#"
+			}
+			if err := validateTopicFilter(project.ExplorerFilter); err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+
+			project.PayloadDecoders = r.FormValue("payload-decoders")
+			if _, err := newPayloadDecoders(project); err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+
+			project.SparkplugEnabled = r.FormValue("sparkplug-enabled") == "on"
+
+			project.TLSServerName = r.FormValue("tls-server-name")
+			project.TLSInsecureSkipVerify = r.FormValue("tls-insecure-skip-verify") == "on"
+
+			if _, err := newTLSConfig(project); err != nil {
+				fmt.Fprintf(w, "ERROR: %v", err)
+				return
+			}
+
+			encryptedTLSClientKey, err := EncryptSecret(string(project.TLSClientKey))
+			if err != nil {
+				log.Fatal(err)
+				return
+			}
 
-			stmt, err := db.Prepare("UPDATE projects set name = ?, broker_client_id = ?, broker_address = ?, broker_port = ?, broker_protocol = ? where id = ?")
+			stmt, err := db.Prepare("UPDATE projects set name = ?, broker_client_id = ?, broker_address = ?, broker_port = ?, broker_protocol = ?, broker_protocol_version = ?, broker_username = ?, broker_password = ?, tls_ca_cert = ?, tls_client_cert = ?, tls_client_key = ?, tls_server_name = ?, tls_insecure_skip_verify = ?, broker_ws_path = ?, broker_ws_headers = ?, buffer_depth = ?, buffer_max_bytes = ?, will_topic = ?, will_payload = ?, will_qos = ?, will_retain = ?, birth_topic = ?, birth_payload = ?, birth_qos = ?, birth_retain = ?, explorer_filter = ?, payload_decoders = ?, proto_descriptor_set = ?, sparkplug_enabled = ? where id = ?")
 			if err != nil {
 				log.Fatal(err)
 				return
 			}
 
-			_, err = stmt.Exec(name, brokerClientID, brokerAddress, brokerPort, brokerProtocol, project.ID)
+			_, err = stmt.Exec(name, brokerClientID, brokerAddress, brokerPort, brokerProtocol, brokerProtocolVersion, brokerUsername, encryptedBrokerPassword, project.TLSCACert, project.TLSClientCert, encryptedTLSClientKey, project.TLSServerName, project.TLSInsecureSkipVerify, brokerWebSocketPath, brokerWebSocketHeaders, bufferDepth, bufferMaxBytes, project.WillTopic, project.WillPayload, project.WillQoS, project.WillRetain, project.BirthTopic, project.BirthPayload, project.BirthQoS, project.BirthRetain, project.ExplorerFilter, project.PayloadDecoders, project.ProtoDescriptorSet, project.SparkplugEnabled, project.ID)
 			if err != nil {
 				log.Fatal(err)
 				return
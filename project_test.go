@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection would open a database of its own
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	createProjectsTable(db)
+	migrateProjectsTable(db)
+
+	return db
+}
+
+func TestGetProjectBySlugWithRotatedKey(t *testing.T) {
+	db := newTestDB(t)
+	setTestSecretKey(t, bytes.Repeat([]byte{1}, 32))
+
+	password, err := EncryptSecret("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := EncryptSecret("client key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("INSERT INTO projects(team_id, name, slug, broker_client_id, broker_address, broker_port, broker_protocol, broker_password, tls_client_cert, tls_client_key) VALUES (1, 'Plant', 'plant', 'studio', 'localhost', 1883, 'tcp', ?, 'client cert', ?)", password, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	project, err := GetProjectBySlug(db, "plant")
+	if err != nil || project.BrokerPassword != "password" || string(project.TLSClientKey) != "client key" || project.TLSClientKeyLost {
+		t.Fatalf("got %v, %v, want the decrypted secrets", project, err)
+	}
+
+	// the project stays reachable, so the secrets can be entered again
+	secretKey = bytes.Repeat([]byte{2}, 32)
+	project, err = GetProjectBySlug(db, "plant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if project.Name != "Plant" || project.BrokerPassword != "" || len(project.TLSClientKey) != 0 {
+		t.Errorf("got name %q, password %q and client key %q, want the project without secrets", project.Name, project.BrokerPassword, project.TLSClientKey)
+	}
+
+	// the settings and connecting ask for the key again
+	if !project.TLSClientKeyLost {
+		t.Error("got the client key not marked as lost")
+	}
+	if _, err := newTLSConfig(project); err == nil || !strings.Contains(err.Error(), "could not be decrypted") {
+		t.Errorf("got error %v, want the client key to be uploaded again", err)
+	}
+	project.TLSClientCert = nil
+	if _, err := newTLSConfig(project); err != nil {
+		t.Errorf("got error %v after removing the client certificate", err)
+	}
+}
+
+func TestMigrateTLSBrokerProtocols(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, protocol := range []string{"tls", "mqtts", "tcp", "wss"} {
+		_, err := db.Exec("INSERT INTO projects(team_id, name, slug, broker_client_id, broker_address, broker_port, broker_protocol) VALUES (1, ?, ?, 'studio', 'broker.test', 8883, ?)", protocol, protocol, protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrateProjectsTable(db)
+
+	tests := []struct {
+		slug string
+		want string
+	}{
+		{"tls", "ssl://broker.test:8883"},
+		{"mqtts", "ssl://broker.test:8883"},
+		{"tcp", "tcp://broker.test:8883"},
+		{"wss", "wss://broker.test:8883/mqtt"},
+	}
+
+	for _, test := range tests {
+		project, err := GetProjectBySlug(db, test.slug)
+		if err != nil {
+			t.Errorf("%s: %v", test.slug, err)
+			continue
+		}
+		if url := project.BrokerURL(); url != test.want {
+			t.Errorf("%s: got %s, want %s", test.slug, url, test.want)
+		}
+	}
+}
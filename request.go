@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// RequestResult is the outcome of the last request sent by a REQUEST widget.
+type RequestResult struct {
+	Payload string
+	Latency int64 // milliseconds
+	Error string
+	At time.Time
+}
+
+type pendingRequest struct {
+	responseTopic string
+	correlationField string // JSON field holding the ID, empty for MQTT 5
+	reply chan Message
+}
+
+// Publishes the request and waits for the reply on the response topic.
+// MQTT 5 requests carry the response topic and correlation data as
+// properties, on 3.1.1 the correlation ID is written into the JSON field of
+// the payload and the reply must echo it.
+func (c *Connection) Request(message Message, responseTopic string, correlationField string, timeout time.Duration) (Message, error) {
+	id, err := newCorrelationID()
+	if err != nil {
+		return Message{}, err
+	}
+
+	pending := pendingRequest{
+		responseTopic: responseTopic,
+		reply: make(chan Message, 1),
+	}
+
+	if c.ProtocolVersion == MQTTVersion5 {
+		properties := MessageProperties{}
+		if message.Properties != nil {
+			properties = *message.Properties
+		}
+		properties.ResponseTopic = responseTopic
+		properties.CorrelationData = []byte(id)
+		message.Properties = &properties
+	} else {
+		if correlationField == "" {
+			return Message{}, errors.New("a correlation field is required for MQTT 3.1.1 requests")
+		}
+
+		message.Payload, err = setJSONField(message.Payload, correlationField, id)
+		if err != nil {
+			return Message{}, err
+		}
+		pending.correlationField = correlationField
+	}
+
+	c.mutex.Lock()
+	if c.requests == nil {
+		c.requests = make(map[string]pendingRequest)
+	}
+	c.requests[id] = pending
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.requests, id)
+		c.mutex.Unlock()
+	}()
+
+	if err := c.SendMessage(message); err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case reply := <-pending.reply:
+		return reply, nil
+	case <-time.After(timeout):
+		return Message{}, fmt.Errorf("no reply on %s within %s", responseTopic, timeout)
+	}
+}
+
+// Hands the message to the request waiting for it on the topic of the
+// message. Must be called while holding the mutex.
+func (c *Connection) matchRequest(message Message) {
+	if len(c.requests) == 0 {
+		return
+	}
+
+	if message.Properties != nil && message.Properties.CorrelationData != nil {
+		pending, found := c.requests[string(message.Properties.CorrelationData)]
+		if found && pending.responseTopic == message.Topic {
+			deliverReply(pending, message)
+			return
+		}
+	}
+
+	var fields map[string]any
+	for id, pending := range c.requests {
+		if pending.correlationField == "" || pending.responseTopic != message.Topic {
+			continue
+		}
+
+		if fields == nil && json.Unmarshal(message.Payload, &fields) != nil {
+			return
+		}
+
+		if value, found := fields[pending.correlationField]; found && fmt.Sprint(value) == id {
+			deliverReply(pending, message)
+			return
+		}
+	}
+}
+
+func deliverReply(pending pendingRequest, message Message) {
+	// only the first reply counts
+	select {
+	case pending.reply <- message:
+	default:
+	}
+}
+
+// Stores the result shown by the widget and tells listeners about it.
+func (c *Connection) setRequestResult(widgetID int, result RequestResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.requestResults == nil {
+		c.requestResults = make(map[int]RequestResult)
+	}
+	c.requestResults[widgetID] = result
+
+	c.notify(ConnectionEvent{
+		Type: EventRequest,
+		WidgetID: widgetID,
+	})
+}
+
+func (c *Connection) RequestResult(widgetID int) (RequestResult, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	result, found := c.requestResults[widgetID]
+	return result, found
+}
+
+// Sends the request of the widget and records the reply or the failure.
+func sendWidgetRequest(connection *Connection, projectWidget ProjectWidget, config RequestWidgetConfig) error {
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Duration(DefaultRequestTimeout) * time.Second
+	}
+
+	started := time.Now()
+	reply, err := connection.Request(Message{
+		Topic: config.Topic,
+		Payload: []byte(config.Payload),
+		QoS: config.QoS,
+		Properties: config.MessageProperties(),
+	}, config.ResponseTopic, config.CorrelationField, timeout)
+
+	result := RequestResult{
+		Latency: time.Since(started).Milliseconds(),
+		At: time.Now(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Payload = string(reply.Payload)
+	}
+
+	connection.setRequestResult(projectWidget.ID, result)
+	return err
+}
+
+func newCorrelationID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// Sets a top level field of a JSON object payload, an empty payload is
+// treated as an empty object. The rest of the payload is kept as it is, so
+// large numbers and the order of the fields survive.
+func setJSONField(payload []byte, field string, value string) ([]byte, error) {
+	encodedField, err := json.Marshal(field)
+	if err != nil {
+		return nil, err
+	}
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 || string(payload) == "null" {
+		return []byte("{" + string(encodedField) + ":" + string(encodedValue) + "}"), nil
+	}
+
+	invalid := func(err error) error {
+		return fmt.Errorf("request payload must be a JSON object: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, invalid(err)
+	}
+	if token != json.Delim('{') {
+		return nil, invalid(fmt.Errorf("found %v", token))
+	}
+
+	// offsets of the value of the field, the last one counts like in
+	// json.Unmarshal
+	start, end := -1, -1
+	empty := true
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, invalid(err)
+		}
+
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, invalid(err)
+		}
+
+		if key == field {
+			end = int(decoder.InputOffset())
+			start = end - len(raw)
+		}
+		empty = false
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, invalid(err)
+	}
+	closing := int(decoder.InputOffset()) - 1
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, invalid(errors.New("unexpected data after the object"))
+	}
+
+	var result []byte
+	if start >= 0 {
+		result = append(result, payload[:start]...)
+		result = append(result, encodedValue...)
+		return append(result, payload[end:]...), nil
+	}
+
+	result = append(result, payload[:closing]...)
+	if !empty {
+		result = append(result, ',')
+	}
+	result = append(result, encodedField...)
+	result = append(result, ':')
+	result = append(result, encodedValue...)
+	return append(result, payload[closing:]...), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSetJSONField(t *testing.T) {
+	tests := []struct {
+		payload string
+		want string
+	}{
+		{"", `{"id":"abc"}`},
+		{"null", `{"id":"abc"}`},
+		{"{}", `{"id":"abc"}`},
+		{" { } ", `{ "id":"abc"}`},
+		{`{"b":1,"a":2}`, `{"b":1,"a":2,"id":"abc"}`},
+		{`{"big":12345678901234567890,"f":1.50}`, `{"big":12345678901234567890,"f":1.50,"id":"abc"}`},
+		{`{"id":"old","n":1}`, `{"id":"abc","n":1}`},
+		{`{"id": {"nested": [1, 2]}, "n": 1}`, `{"id": "abc", "n": 1}`},
+		{`{"a": {"id": 1}}`, `{"a": {"id": 1},"id":"abc"}`},
+		{"{\n  \"a\": \"x\"\n}\n", "{\n  \"a\": \"x\"\n,\"id\":\"abc\"}"},
+	}
+
+	for _, test := range tests {
+		got, err := setJSONField([]byte(test.payload), "id", "abc")
+		if err != nil {
+			t.Errorf("%q: %v", test.payload, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%q: got %s, want %s", test.payload, got, test.want)
+		}
+	}
+}
+
+func TestSetJSONFieldErrors(t *testing.T) {
+	for _, payload := range []string{"[1]", `"id"`, "42", `{"a":}`, `{"a":1`, `{"a":1}{}`, "{1:2}"} {
+		if got, err := setJSONField([]byte(payload), "id", "abc"); err == nil {
+			t.Errorf("%q: got %s, want an error", payload, got)
+		}
+	}
+}
+
+func TestMatchRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		pending pendingRequest
+		message Message
+		want bool
+	}{
+		{"correlation data", pendingRequest{responseTopic: "reply/a"},
+			Message{Topic: "reply/a", Properties: &MessageProperties{CorrelationData: []byte("abc")}}, true},
+		{"correlation data on another topic", pendingRequest{responseTopic: "reply/a"},
+			Message{Topic: "reply/b", Properties: &MessageProperties{CorrelationData: []byte("abc")}}, false},
+		{"correlation field", pendingRequest{responseTopic: "reply/a", correlationField: "id"},
+			Message{Topic: "reply/a", Payload: []byte(`{"id":"abc","ok":true}`)}, true},
+		{"correlation field on another topic", pendingRequest{responseTopic: "reply/a", correlationField: "id"},
+			Message{Topic: "reply/b", Payload: []byte(`{"id":"abc"}`)}, false},
+		{"other correlation ID", pendingRequest{responseTopic: "reply/a", correlationField: "id"},
+			Message{Topic: "reply/a", Payload: []byte(`{"id":"abd"}`)}, false},
+		{"payload without JSON", pendingRequest{responseTopic: "reply/a", correlationField: "id"},
+			Message{Topic: "reply/a", Payload: []byte("abc")}, false},
+	}
+
+	for _, test := range tests {
+		test.pending.reply = make(chan Message, 1)
+		connection := &Connection{
+			requests: map[string]pendingRequest{"abc": test.pending},
+		}
+
+		connection.matchRequest(test.message)
+
+		if got := len(test.pending.reply) == 1; got != test.want {
+			t.Errorf("%s: got reply %v, want %v", test.name, got, test.want)
+		}
+	}
+}
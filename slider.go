@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultSliderPayloadTemplate string = "{{value}}"
+	DefaultSliderDebounce int = 250 // milliseconds
+)
+
+// Placeholder of the slider value in payload templates, Home Assistant
+// writes it with spaces.
+var sliderValuePattern = regexp.MustCompile(`\{\{\s*value\s*\}\}`)
+
+type SliderWidgetData struct {
+	Value float64
+	Text string
+}
+
+// Reads the slider specific fields of the widget forms.
+func parseSliderForm(r *http.Request) (SliderWidgetConfig, error) {
+	config := SliderWidgetConfig{
+		Unit: strings.TrimSpace(r.FormValue("unit")),
+		PayloadTemplate: r.FormValue("payload-template"),
+		StateTopic: strings.TrimSpace(r.FormValue("state-topic")),
+	}
+
+	var err error
+	config.Min, err = parseNumberField(r.FormValue("min"), 0)
+	if err != nil {
+		return config, fmt.Errorf("invalid minimum: %w", err)
+	}
+	config.Max, err = parseNumberField(r.FormValue("max"), 100)
+	if err != nil {
+		return config, fmt.Errorf("invalid maximum: %w", err)
+	}
+	if config.Max <= config.Min {
+		return config, fmt.Errorf("maximum must be greater than the minimum")
+	}
+
+	config.Step, err = parseNumberField(r.FormValue("step"), 1)
+	if err != nil || config.Step <= 0 || config.Step > config.Max - config.Min {
+		return config, fmt.Errorf("step must be a positive number up to the range of the slider")
+	}
+
+	debounce, err := parseNumberField(r.FormValue("debounce"), float64(DefaultSliderDebounce))
+	if err != nil || debounce != math.Trunc(debounce) || debounce < 0 {
+		return config, fmt.Errorf("debounce must be a whole number of milliseconds")
+	}
+	config.Debounce = int(debounce)
+
+	if config.PayloadTemplate == "" {
+		config.PayloadTemplate = DefaultSliderPayloadTemplate
+	}
+	if !sliderValuePattern.MatchString(config.PayloadTemplate) {
+		return config, fmt.Errorf("payload template must contain {{value}}")
+	}
+
+	if config.StateTopic != "" {
+		if err := validatePublishTopic(config.StateTopic); err != nil {
+			return config, fmt.Errorf("invalid state topic: %w", err)
+		}
+	}
+
+	return config, nil
+}
+
+// Snaps the value to the steps of the slider, which start at the minimum,
+// and returns it formatted with the decimals of the minimum and the step.
+func (c SliderWidgetConfig) Value(text string) (string, error) {
+	number, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return "", fmt.Errorf("value %q is not a number", text)
+	}
+	if number < c.Min || number > c.Max {
+		return "", fmt.Errorf("value %s is outside of %s to %s", text, strconv.FormatFloat(c.Min, 'f', -1, 64), strconv.FormatFloat(c.Max, 'f', -1, 64))
+	}
+
+	steps := math.Round((number - c.Min) / c.Step)
+	if c.Min + steps * c.Step - c.Max > c.Step * 1e-9 {
+		// the maximum is not always a step, rounding errors are ignored
+		steps--
+	}
+
+	return c.format(c.Min + steps * c.Step), nil
+}
+
+// Returns the payload published for the value.
+func (c SliderWidgetConfig) Payload(text string) (string, error) {
+	value, err := c.Value(text)
+	if err != nil {
+		return "", err
+	}
+
+	return sliderValuePattern.ReplaceAllLiteralString(c.PayloadTemplate, value), nil
+}
+
+func (c SliderWidgetConfig) format(number float64) string {
+	decimals := 0
+	for _, bound := range []float64{c.Min, c.Step} {
+		if _, fraction, found := strings.Cut(strconv.FormatFloat(bound, 'f', -1, 64), "."); found {
+			decimals = max(decimals, len(fraction))
+		}
+	}
+
+	return strconv.FormatFloat(number, 'f', decimals, 64)
+}
+
+// Returns the confirmed value of the device read from the state topic.
+func (c SliderWidgetConfig) Data(value string) (SliderWidgetData, error) {
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return SliderWidgetData{}, fmt.Errorf("value %q is not a number", value)
+	}
+
+	return SliderWidgetData{
+		Value: number,
+		Text: strconv.FormatFloat(number, 'f', -1, 64),
+	}, nil
+}
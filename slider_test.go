@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSliderWidgetConfigValue(t *testing.T) {
+	tests := []struct {
+		config SliderWidgetConfig
+		text string
+		want string
+		err string
+	}{
+		{SliderWidgetConfig{Min: 0, Max: 100, Step: 1}, "42.4", "42", ""},
+		{SliderWidgetConfig{Min: 0, Max: 100, Step: 1}, " 42.5 ", "43", ""},
+		{SliderWidgetConfig{Min: 0, Max: 1, Step: 0.05}, "0.33", "0.35", ""},
+		{SliderWidgetConfig{Min: 0, Max: 0.3, Step: 0.1}, "0.3", "0.3", ""},
+
+		// the steps start at the minimum and take its decimals
+		{SliderWidgetConfig{Min: 0.5, Max: 10, Step: 1}, "0.5", "0.5", ""},
+		{SliderWidgetConfig{Min: 0.5, Max: 10, Step: 1}, "1.4", "1.5", ""},
+		{SliderWidgetConfig{Min: -0.25, Max: 1, Step: 0.5}, "0", "0.25", ""},
+		{SliderWidgetConfig{Min: 2, Max: 20, Step: 5}, "6", "7", ""},
+
+		// a maximum off the steps is never exceeded
+		{SliderWidgetConfig{Min: 0, Max: 10.25, Step: 0.5}, "10.25", "10.0", ""},
+		{SliderWidgetConfig{Min: 0.5, Max: 10, Step: 1}, "10", "9.5", ""},
+
+		{SliderWidgetConfig{Min: 0, Max: 100, Step: 1}, "-1", "", "value -1 is outside of 0 to 100"},
+		{SliderWidgetConfig{Min: 0.5, Max: 10.25, Step: 1}, "11", "", "value 11 is outside of 0.5 to 10.25"},
+		{SliderWidgetConfig{Min: 0, Max: 100, Step: 1}, "half", "", "is not a number"},
+		{SliderWidgetConfig{Min: 0, Max: 100, Step: 1}, "NaN", "", "is not a number"},
+	}
+
+	for _, test := range tests {
+		got, err := test.config.Value(test.text)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%+v %q: got error %v, want %q", test.config, test.text, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v %q: %v", test.config, test.text, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%+v %q: got %s, want %s", test.config, test.text, got, test.want)
+		}
+	}
+}
+
+func TestSliderWidgetConfigPayload(t *testing.T) {
+	tests := []struct {
+		template string
+		want string
+	}{
+		{"{{value}}", "1.5"},
+		{`{"setpoint": {{ value }}}`, `{"setpoint": 1.5}`},
+		{"{{value}}/{{value}}", "1.5/1.5"},
+		{"$1 {{value}}", "$1 1.5"},
+	}
+
+	for _, test := range tests {
+		config := SliderWidgetConfig{Min: 0.5, Max: 10, Step: 1, PayloadTemplate: test.template}
+		got, err := config.Payload("1.7")
+		if err != nil {
+			t.Errorf("%q: %v", test.template, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %s, want %s", test.template, got, test.want)
+		}
+	}
+
+	config := SliderWidgetConfig{Min: 0, Max: 10, Step: 1, PayloadTemplate: "{{value}}"}
+	if got, err := config.Payload("12"); err == nil {
+		t.Errorf("got %s, want an error for a value outside of the range", got)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+type ProjectSparkplugViewData struct {
+	Project *Project
+	Sections []ProjectSection
+}
+
+type SparkplugNodes struct {
+	Status string
+	Enabled bool
+	Groups []SparkplugGroup
+}
+
+func projectSparkplugHandler(db *sql.DB, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		sections, err := getProjectSections(db, project.ID)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		tmpl := template.Must(template.ParseFiles("./views/layout.html", "./views/project-sparkplug.html"))
+		tmpl.Execute(w, ProjectSparkplugViewData{
+			Project: project,
+			Sections: sections,
+		})
+	}
+}
+
+// Serves the groups, edge nodes, devices and metrics polled by the Sparkplug
+// browser.
+func projectSparkplugNodesHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		nodes := SparkplugNodes{
+			Status: connections.StatusText(project.ID),
+			Enabled: project.SparkplugEnabled,
+			Groups: []SparkplugGroup{},
+		}
+		if connection := connections.Get(project.ID); connection != nil {
+			nodes.Groups = connection.SparkplugGroups()
+		}
+
+		resp, err := json.Marshal(nodes)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	}
+}
+
+// Sends the rebirth command to an edge node, the answer is "OK" or the error
+// text.
+func projectSparkplugRebirthHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			fmt.Fprintf(w, "Only POST method is supported.")
+			return
+		}
+
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		group := r.FormValue("group")
+		node := r.FormValue("node")
+		if group == "" || node == "" {
+			http.Error(w, "ERROR: group and node are required", http.StatusBadRequest)
+			return
+		}
+
+		connection := connections.Get(project.ID)
+		if connection == nil {
+			http.Error(w, "ERROR: not connected to the broker", http.StatusBadGateway)
+			return
+		}
+
+		if err := connection.SparkplugRebirth(group, node); err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		fmt.Fprint(w, "OK")
+	}
+}
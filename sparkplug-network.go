@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SparkplugNetwork tracks the edge nodes and devices of a Sparkplug B
+// infrastructure from their birth and death certificates. It is not safe for
+// concurrent use, Connection guards it with its mutex.
+type SparkplugNetwork struct {
+	nodes map[string]*sparkplugNode // by group and node ID
+}
+
+type sparkplugNode struct {
+	group string
+	name string
+	bdSeq *uint64 // of the last NBIRTH, NDEATH messages must carry the same
+	sparkplugEntity
+	devices map[string]*sparkplugEntity
+}
+
+// sparkplugEntity is the state shared by edge nodes and devices.
+type sparkplugEntity struct {
+	online bool
+	born bool // a birth certificate was seen, aliases can be resolved
+	lastSeen time.Time
+	aliases map[uint64]string
+	metrics map[string]*sparkplugMetricState
+	unknownAliases int // DATA metrics dropped since the last birth
+}
+
+type sparkplugMetricState struct {
+	dataType uint32
+	value any
+	timestamp time.Time // as sent by the edge node
+	updatedAt time.Time
+}
+
+// SparkplugGroup is a snapshot of a group, as shown by the Sparkplug browser.
+type SparkplugGroup struct {
+	Name string
+	Nodes []SparkplugNodeInfo
+}
+
+type SparkplugNodeInfo struct {
+	Name string
+	SparkplugEntityInfo
+	Devices []SparkplugDeviceInfo
+}
+
+type SparkplugDeviceInfo struct {
+	Name string
+	SparkplugEntityInfo
+}
+
+type SparkplugEntityInfo struct {
+	Online bool
+	Born bool
+	LastSeen time.Time
+	UnknownAliases int
+	Metrics []SparkplugMetricInfo
+}
+
+type SparkplugMetricInfo struct {
+	Name string
+	Topic string // virtual topic for widgets
+	DataType string
+	Value string
+	Timestamp time.Time
+	UpdatedAt time.Time
+}
+
+func NewSparkplugNetwork() *SparkplugNetwork {
+	return &SparkplugNetwork{
+		nodes: make(map[string]*sparkplugNode),
+	}
+}
+
+func newSparkplugEntity() sparkplugEntity {
+	return sparkplugEntity{
+		aliases: make(map[uint64]string),
+		metrics: make(map[string]*sparkplugMetricState),
+	}
+}
+
+// Applies a message received on a spBv1.0 topic and returns one message per
+// metric on its virtual topic, historical metrics are left out.
+func (s *SparkplugNetwork) Handle(message Message) ([]Message, error) {
+	topic, ok := parseSparkplugTopic(message.Topic)
+	if !ok {
+		// e.g. the STATE messages of host applications
+		return nil, nil
+	}
+
+	switch topic.MessageType {
+	case "NBIRTH", "NDEATH", "NDATA", "DBIRTH", "DDEATH", "DDATA":
+	default:
+		// commands are not state
+		return nil, nil
+	}
+
+	payload, err := decodeSparkplugPayload(message.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", message.Topic, err)
+	}
+
+	node := s.node(topic.Group, topic.Node)
+	entity := &node.sparkplugEntity
+	if topic.Device != "" {
+		entity = node.device(topic.Device)
+	}
+
+	switch topic.MessageType {
+	case "NBIRTH":
+		node.sparkplugEntity = newSparkplugEntity()
+		node.born = true
+		node.bdSeq = sparkplugBdSeq(payload)
+		// devices announce themselves again after the node
+		for _, device := range node.devices {
+			device.online = false
+		}
+	case "DBIRTH":
+		*entity = newSparkplugEntity()
+		entity.born = true
+		node.online = true
+	case "NDEATH":
+		// a stale will of an older session must not kill the current one
+		if bdSeq := sparkplugBdSeq(payload); bdSeq != nil && node.bdSeq != nil && *bdSeq != *node.bdSeq {
+			return nil, nil
+		}
+		node.online = false
+		node.lastSeen = message.ReceivedAt
+		for _, device := range node.devices {
+			device.online = false
+		}
+		return nil, nil
+	case "DDEATH":
+		entity.online = false
+		entity.lastSeen = message.ReceivedAt
+		return nil, nil
+	}
+
+	entity.online = true
+	entity.lastSeen = message.ReceivedAt
+
+	var messages []Message
+	for _, metric := range payload.Metrics {
+		name := metric.Name
+		if name == "" && metric.Alias != nil {
+			name = entity.aliases[*metric.Alias]
+		}
+		if name == "" {
+			entity.unknownAliases++
+			continue
+		}
+		if metric.Alias != nil && metric.Name != "" {
+			entity.aliases[*metric.Alias] = name
+		}
+
+		state, found := entity.metrics[name]
+		if !found {
+			state = &sparkplugMetricState{}
+			entity.metrics[name] = state
+		}
+		if metric.DataType != 0 {
+			state.dataType = metric.DataType
+		}
+
+		if metric.IsHistorical {
+			continue
+		}
+
+		value, err := metric.decodeValue(state.dataType)
+		if err != nil {
+			continue
+		}
+
+		state.value = value
+		state.updatedAt = message.ReceivedAt
+		state.timestamp = time.Time{}
+		if timestamp := metric.Timestamp; timestamp != 0 {
+			state.timestamp = time.UnixMilli(int64(timestamp))
+		} else if payload.Timestamp != 0 {
+			state.timestamp = time.UnixMilli(int64(payload.Timestamp))
+		}
+
+		messages = append(messages, Message{
+			Topic: sparkplugMetricTopic(topic.Group, topic.Node, topic.Device, name),
+			Payload: []byte(sparkplugValueText(value)),
+			QoS: message.QoS,
+			Retained: message.Retained,
+			ReceivedAt: message.ReceivedAt,
+		})
+	}
+
+	return messages, nil
+}
+
+// Returns the data type announced for the metric, 0 when it is unknown.
+func (s *SparkplugNetwork) DataType(topic sparkplugTopic, metric string) uint32 {
+	node, found := s.nodes[topic.Group + "/" + topic.Node]
+	if !found {
+		return 0
+	}
+
+	entity := &node.sparkplugEntity
+	if topic.Device != "" {
+		entity, found = node.devices[topic.Device]
+		if !found {
+			return 0
+		}
+	}
+
+	if state, found := entity.metrics[metric]; found {
+		return state.dataType
+	}
+
+	return 0
+}
+
+func (s *SparkplugNetwork) node(group string, name string) *sparkplugNode {
+	key := group + "/" + name
+	node, found := s.nodes[key]
+	if !found {
+		node = &sparkplugNode{
+			group: group,
+			name: name,
+			sparkplugEntity: newSparkplugEntity(),
+			devices: make(map[string]*sparkplugEntity),
+		}
+		s.nodes[key] = node
+	}
+
+	return node
+}
+
+func (n *sparkplugNode) device(name string) *sparkplugEntity {
+	device, found := n.devices[name]
+	if !found {
+		entity := newSparkplugEntity()
+		device = &entity
+		n.devices[name] = device
+	}
+
+	return device
+}
+
+// Returns the bdSeq metric of a birth or death certificate.
+func sparkplugBdSeq(payload *SparkplugPayload) *uint64 {
+	for _, metric := range payload.Metrics {
+		if metric.Name != "bdSeq" {
+			continue
+		}
+
+		switch value := metric.Value.(type) {
+		case uint64:
+			return &value
+		case int64:
+			bdSeq := uint64(value)
+			return &bdSeq
+		}
+	}
+
+	return nil
+}
+
+// Returns the groups with their nodes, devices and metrics sorted by name.
+func (s *SparkplugNetwork) Snapshot() []SparkplugGroup {
+	groups := map[string]*SparkplugGroup{}
+	for _, node := range s.nodes {
+		group, found := groups[node.group]
+		if !found {
+			group = &SparkplugGroup{
+				Name: node.group,
+			}
+			groups[node.group] = group
+		}
+
+		info := SparkplugNodeInfo{
+			Name: node.name,
+			SparkplugEntityInfo: node.snapshot(node.group, node.name, ""),
+			Devices: []SparkplugDeviceInfo{},
+		}
+		for name, device := range node.devices {
+			info.Devices = append(info.Devices, SparkplugDeviceInfo{
+				Name: name,
+				SparkplugEntityInfo: device.snapshot(node.group, node.name, name),
+			})
+		}
+		slices.SortFunc(info.Devices, func(a, b SparkplugDeviceInfo) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+
+		group.Nodes = append(group.Nodes, info)
+	}
+
+	snapshot := []SparkplugGroup{}
+	for _, group := range groups {
+		slices.SortFunc(group.Nodes, func(a, b SparkplugNodeInfo) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+		snapshot = append(snapshot, *group)
+	}
+	slices.SortFunc(snapshot, func(a, b SparkplugGroup) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return snapshot
+}
+
+func (e *sparkplugEntity) snapshot(group string, node string, device string) SparkplugEntityInfo {
+	info := SparkplugEntityInfo{
+		Online: e.online,
+		Born: e.born,
+		LastSeen: e.lastSeen,
+		UnknownAliases: e.unknownAliases,
+		Metrics: []SparkplugMetricInfo{},
+	}
+
+	for name, state := range e.metrics {
+		metric := SparkplugMetricInfo{
+			Name: name,
+			Topic: sparkplugMetricTopic(group, node, device, name),
+			DataType: sparkplugDataTypeName(state.dataType),
+			Timestamp: state.timestamp,
+			UpdatedAt: state.updatedAt,
+		}
+		if !state.updatedAt.IsZero() {
+			metric.Value = sparkplugValueText(state.value)
+		}
+		info.Metrics = append(info.Metrics, metric)
+	}
+	slices.SortFunc(info.Metrics, func(a, b SparkplugMetricInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return info
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Applies the payload on the Sparkplug topic and returns the metric messages
+// by topic.
+func handleSparkplugTest(t *testing.T, network *SparkplugNetwork, topic string, payload []byte) map[string]string {
+	t.Helper()
+
+	messages, err := network.Handle(Message{
+		Topic: topic,
+		Payload: payload,
+		ReceivedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("%s: %v", topic, err)
+	}
+
+	values := map[string]string{}
+	for _, message := range messages {
+		values[message.Topic] = string(message.Payload)
+	}
+
+	return values
+}
+
+func sparkplugTestNBIRTH(bdSeq uint64) []byte {
+	return sparkplugTestPayload(0,
+		sparkplugTestMetric{name: "bdSeq", dataType: sparkplugUInt64, value: sparkplugTestVarint(11, bdSeq)},
+		sparkplugTestMetric{name: "Temperature", alias: sparkplugTestAlias(1), dataType: sparkplugDouble, value: sparkplugTestDouble(20.5)},
+		sparkplugTestMetric{name: "Running", alias: sparkplugTestAlias(2), dataType: sparkplugBoolean, value: sparkplugTestVarint(14, 0)},
+	)
+}
+
+func sparkplugTestDBIRTH() []byte {
+	return sparkplugTestPayload(1,
+		sparkplugTestMetric{name: "Speed", alias: sparkplugTestAlias(1), dataType: sparkplugInt32, value: sparkplugTestInt32(900)},
+	)
+}
+
+func TestSparkplugNetworkResolvesAliases(t *testing.T) {
+	network := NewSparkplugNetwork()
+
+	births := handleSparkplugTest(t, network, "spBv1.0/plant/NBIRTH/edge1", sparkplugTestNBIRTH(3))
+	if births["$sparkplug/plant/edge1/node/Temperature"] != "20.5" || births["$sparkplug/plant/edge1/node/Running"] != "false" {
+		t.Errorf("NBIRTH: got %v", births)
+	}
+
+	handleSparkplugTest(t, network, "spBv1.0/plant/DBIRTH/edge1/pump", sparkplugTestDBIRTH())
+
+	// DATA messages carry aliases only, the data type comes from the birth
+	values := handleSparkplugTest(t, network, "spBv1.0/plant/NDATA/edge1", sparkplugTestPayload(2,
+		sparkplugTestMetric{alias: sparkplugTestAlias(1), value: sparkplugTestDouble(21.25)},
+		sparkplugTestMetric{alias: sparkplugTestAlias(2), value: sparkplugTestVarint(14, 1)},
+	))
+	if len(values) != 2 || values["$sparkplug/plant/edge1/node/Temperature"] != "21.25" || values["$sparkplug/plant/edge1/node/Running"] != "true" {
+		t.Errorf("NDATA: got %v", values)
+	}
+
+	// devices have aliases of their own
+	values = handleSparkplugTest(t, network, "spBv1.0/plant/DDATA/edge1/pump", sparkplugTestPayload(3,
+		sparkplugTestMetric{alias: sparkplugTestAlias(1), value: sparkplugTestInt32(-12)},
+	))
+	if len(values) != 1 || values["$sparkplug/plant/edge1/device/pump/Speed"] != "-12" {
+		t.Errorf("DDATA: got %v", values)
+	}
+
+	// historical values are not the current state
+	values = handleSparkplugTest(t, network, "spBv1.0/plant/NDATA/edge1", sparkplugTestPayload(4,
+		sparkplugTestMetric{alias: sparkplugTestAlias(1), historical: true, value: sparkplugTestDouble(5)},
+	))
+	if len(values) != 0 {
+		t.Errorf("historical NDATA: got %v", values)
+	}
+
+	node := network.nodes["plant/edge1"]
+	if node.unknownAliases != 0 || node.devices["pump"].unknownAliases != 0 {
+		t.Errorf("got %d and %d unknown aliases, want none", node.unknownAliases, node.devices["pump"].unknownAliases)
+	}
+	if dataType := network.DataType(sparkplugTopic{Group: "plant", Node: "edge1", Device: "pump"}, "Speed"); dataType != sparkplugInt32 {
+		t.Errorf("got data type %d for Speed, want Int32", dataType)
+	}
+}
+
+func TestSparkplugNetworkCountsUnknownAliases(t *testing.T) {
+	network := NewSparkplugNetwork()
+
+	// joined after the birth, the aliases cannot be resolved
+	values := handleSparkplugTest(t, network, "spBv1.0/plant/NDATA/edge1", sparkplugTestPayload(5,
+		sparkplugTestMetric{alias: sparkplugTestAlias(1), value: sparkplugTestDouble(21)},
+		sparkplugTestMetric{alias: sparkplugTestAlias(2), value: sparkplugTestVarint(14, 1)},
+	))
+	if len(values) != 0 {
+		t.Errorf("got %v before the birth, want nothing", values)
+	}
+
+	node := network.nodes["plant/edge1"]
+	if node.unknownAliases != 2 || node.born {
+		t.Errorf("got %d unknown aliases and born %v, want 2 and false", node.unknownAliases, node.born)
+	}
+
+	handleSparkplugTest(t, network, "spBv1.0/plant/NBIRTH/edge1", sparkplugTestNBIRTH(0))
+
+	node = network.nodes["plant/edge1"]
+	if node.unknownAliases != 0 || !node.born {
+		t.Errorf("got %d unknown aliases and born %v after the birth, want 0 and true", node.unknownAliases, node.born)
+	}
+
+	// an alias the birth did not announce
+	handleSparkplugTest(t, network, "spBv1.0/plant/NDATA/edge1", sparkplugTestPayload(6,
+		sparkplugTestMetric{alias: sparkplugTestAlias(9), value: sparkplugTestDouble(1)},
+	))
+	if node.unknownAliases != 1 {
+		t.Errorf("got %d unknown aliases, want 1", node.unknownAliases)
+	}
+}
+
+func TestSparkplugNetworkIgnoresStaleNDEATH(t *testing.T) {
+	network := NewSparkplugNetwork()
+
+	handleSparkplugTest(t, network, "spBv1.0/plant/NBIRTH/edge1", sparkplugTestNBIRTH(3))
+	handleSparkplugTest(t, network, "spBv1.0/plant/DBIRTH/edge1/pump", sparkplugTestDBIRTH())
+
+	death := func(bdSeq uint64) []byte {
+		return sparkplugTestPayload(0,
+			sparkplugTestMetric{name: "bdSeq", dataType: sparkplugUInt64, value: sparkplugTestVarint(11, bdSeq)},
+		)
+	}
+
+	// the will of the previous session arrives late
+	handleSparkplugTest(t, network, "spBv1.0/plant/NDEATH/edge1", death(2))
+
+	node := network.nodes["plant/edge1"]
+	if !node.online || !node.devices["pump"].online {
+		t.Fatalf("got node online %v and device online %v after a stale NDEATH, want both online", node.online, node.devices["pump"].online)
+	}
+
+	handleSparkplugTest(t, network, "spBv1.0/plant/NDEATH/edge1", death(3))
+
+	if node.online || node.devices["pump"].online {
+		t.Errorf("got node online %v and device online %v after the NDEATH, want both offline", node.online, node.devices["pump"].online)
+	}
+}
+
+func TestSparkplugNetworkRejectsMalformedPayloads(t *testing.T) {
+	network := NewSparkplugNetwork()
+
+	_, err := network.Handle(Message{
+		Topic: "spBv1.0/plant/NDATA/edge1",
+		Payload: sparkplugTestNBIRTH(1)[:10],
+	})
+	if err == nil {
+		t.Error("got no error for a truncated payload")
+	}
+
+	// commands and STATE messages are no state of the node
+	for _, topic := range []string{"spBv1.0/plant/NCMD/edge1", "spBv1.0/STATE/host"} {
+		messages, err := network.Handle(Message{
+			Topic: topic,
+			Payload: []byte{0xff},
+		})
+		if err != nil || messages != nil {
+			t.Errorf("%s: got %v, %v, want nothing", topic, messages, err)
+		}
+	}
+}
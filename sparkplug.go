@@ -0,0 +1,599 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	sparkplugNamespace string = "spBv1.0"
+	sparkplugTopicFilter string = "spBv1.0/#"
+	sparkplugVirtualPrefix string = "$sparkplug/" // topics of the decoded metrics
+)
+
+// Sparkplug B metric data types, the index is the value used on the wire.
+var sparkplugDataTypes = []string{
+	"Unknown", "Int8", "Int16", "Int32", "Int64", "UInt8", "UInt16", "UInt32",
+	"UInt64", "Float", "Double", "Boolean", "String", "DateTime", "Text",
+	"UUID", "DataSet", "Bytes", "File", "Template", "PropertySet",
+	"PropertySetList", "Int8Array", "Int16Array", "Int32Array", "Int64Array",
+	"UInt8Array", "UInt16Array", "UInt32Array", "UInt64Array", "FloatArray",
+	"DoubleArray", "BooleanArray", "StringArray", "DateTimeArray",
+}
+
+const (
+	sparkplugInt8 uint32 = iota + 1
+	sparkplugInt16
+	sparkplugInt32
+	sparkplugInt64
+	sparkplugUInt8
+	sparkplugUInt16
+	sparkplugUInt32
+	sparkplugUInt64
+	sparkplugFloat
+	sparkplugDouble
+	sparkplugBoolean
+	sparkplugString
+	sparkplugDateTime
+	sparkplugText
+	sparkplugUUID
+	sparkplugDataSet
+	sparkplugBytes
+	sparkplugFile
+	sparkplugTemplate
+	sparkplugPropertySet
+	sparkplugPropertySetList
+	sparkplugInt8Array
+	sparkplugInt16Array
+	sparkplugInt32Array
+	sparkplugInt64Array
+	sparkplugUInt8Array
+	sparkplugUInt16Array
+	sparkplugUInt32Array
+	sparkplugUInt64Array
+	sparkplugFloatArray
+	sparkplugDoubleArray
+	sparkplugBooleanArray
+	sparkplugStringArray
+	sparkplugDateTimeArray
+)
+
+// SparkplugPayload is a decoded Sparkplug B payload. Metric values are
+// decoded with their own data type, DATA messages usually leave it to the
+// birth certificate.
+type SparkplugPayload struct {
+	Timestamp uint64 `json:",omitempty"` // milliseconds since the epoch
+	Metrics []SparkplugMetric
+	Seq *uint64 `json:",omitempty"`
+	UUID string `json:",omitempty"`
+	Body []byte `json:",omitempty"`
+}
+
+type SparkplugMetric struct {
+	Name string `json:",omitempty"`
+	Alias *uint64 `json:",omitempty"`
+	Timestamp uint64 `json:",omitempty"`
+	DataType uint32 `json:",omitempty"`
+	IsHistorical bool `json:",omitempty"`
+	IsTransient bool `json:",omitempty"`
+	IsNull bool `json:",omitempty"`
+	Value any
+
+	raw sparkplugRawValue
+}
+
+// sparkplugRawValue keeps the value field as sent, so DATA metrics can be
+// decoded again with the data type of the birth certificate.
+type sparkplugRawValue struct {
+	field protowire.Number
+	number uint64 // varint and fixed width fields
+	bytes []byte
+}
+
+// Topic of a Sparkplug B message, e.g. spBv1.0/plant/DDATA/edge1/pump.
+type sparkplugTopic struct {
+	Group string
+	MessageType string
+	Node string
+	Device string // empty for node messages
+}
+
+func parseSparkplugTopic(topic string) (sparkplugTopic, bool) {
+	levels := strings.Split(topic, "/")
+	if levels[0] != sparkplugNamespace || len(levels) < 4 || len(levels) > 5 {
+		return sparkplugTopic{}, false
+	}
+
+	parsed := sparkplugTopic{
+		Group: levels[1],
+		MessageType: levels[2],
+		Node: levels[3],
+	}
+	if len(levels) == 5 {
+		parsed.Device = levels[4]
+	}
+
+	return parsed, true
+}
+
+func (t sparkplugTopic) String() string {
+	topic := sparkplugNamespace + "/" + t.Group + "/" + t.MessageType + "/" + t.Node
+	if t.Device != "" {
+		topic += "/" + t.Device
+	}
+
+	return topic
+}
+
+// Returns the virtual topic widgets use for a metric, node metrics live
+// below "node" and device metrics below "device/<device>".
+func sparkplugMetricTopic(group string, node string, device string, metric string) string {
+	if device == "" {
+		return sparkplugVirtualPrefix + group + "/" + node + "/node/" + metric
+	}
+
+	return sparkplugVirtualPrefix + group + "/" + node + "/device/" + device + "/" + metric
+}
+
+// Reports whether the topic or topic filter addresses decoded Sparkplug
+// metrics, those are never subscribed on the broker.
+func isSparkplugTopic(topic string) bool {
+	return strings.HasPrefix(topic, sparkplugVirtualPrefix)
+}
+
+// Splits a virtual metric topic into the Sparkplug topic of its node or
+// device and the metric name.
+func parseSparkplugMetricTopic(topic string) (sparkplugTopic, string, error) {
+	levels := strings.Split(strings.TrimPrefix(topic, sparkplugVirtualPrefix), "/")
+	if !isSparkplugTopic(topic) || len(levels) < 4 {
+		return sparkplugTopic{}, "", fmt.Errorf("%q is not a Sparkplug metric topic", topic)
+	}
+
+	parsed := sparkplugTopic{
+		Group: levels[0],
+		Node: levels[1],
+	}
+
+	switch {
+	case levels[2] == "node":
+		return parsed, strings.Join(levels[3:], "/"), nil
+	case levels[2] == "device" && len(levels) >= 5:
+		parsed.Device = levels[3]
+		return parsed, strings.Join(levels[4:], "/"), nil
+	}
+
+	return sparkplugTopic{}, "", fmt.Errorf("%q is not a Sparkplug metric topic", topic)
+}
+
+func sparkplugDataTypeName(dataType uint32) string {
+	if int(dataType) < len(sparkplugDataTypes) {
+		return sparkplugDataTypes[dataType]
+	}
+
+	return fmt.Sprintf("Unknown (%d)", dataType)
+}
+
+func decodeSparkplugPayload(data []byte) (*SparkplugPayload, error) {
+	payload := &SparkplugPayload{}
+
+	err := walkProtobuf(data, func(field protowire.Number, wireType protowire.Type, value sparkplugRawValue) error {
+		switch field {
+		case 1:
+			payload.Timestamp = value.number
+		case 2:
+			metric, err := decodeSparkplugMetric(value.bytes)
+			if err != nil {
+				return err
+			}
+			payload.Metrics = append(payload.Metrics, metric)
+		case 3:
+			seq := value.number
+			payload.Seq = &seq
+		case 4:
+			payload.UUID = string(value.bytes)
+		case 5:
+			payload.Body = value.bytes
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid Sparkplug B payload: %w", err)
+	}
+
+	return payload, nil
+}
+
+func decodeSparkplugMetric(data []byte) (SparkplugMetric, error) {
+	var metric SparkplugMetric
+
+	err := walkProtobuf(data, func(field protowire.Number, wireType protowire.Type, value sparkplugRawValue) error {
+		switch field {
+		case 1:
+			metric.Name = string(value.bytes)
+		case 2:
+			alias := value.number
+			metric.Alias = &alias
+		case 3:
+			metric.Timestamp = value.number
+		case 4:
+			metric.DataType = uint32(value.number)
+		case 5:
+			metric.IsHistorical = value.number != 0
+		case 6:
+			metric.IsTransient = value.number != 0
+		case 7:
+			metric.IsNull = value.number != 0
+		case 10, 11, 12, 13, 14, 15, 16, 17, 18:
+			metric.raw = value
+		}
+		return nil
+	})
+	if err != nil {
+		return metric, err
+	}
+
+	metric.Value, err = metric.decodeValue(metric.DataType)
+	return metric, err
+}
+
+// Decodes the value with the data type, 0 guesses it from the value field.
+func (m SparkplugMetric) decodeValue(dataType uint32) (any, error) {
+	if m.IsNull || m.raw.field == 0 {
+		return nil, nil
+	}
+
+	raw := m.raw
+	switch dataType {
+	case sparkplugInt8:
+		return int8(raw.number), nil
+	case sparkplugInt16:
+		return int16(raw.number), nil
+	case sparkplugInt32:
+		return int32(raw.number), nil
+	case sparkplugInt64:
+		return int64(raw.number), nil
+	case sparkplugUInt8, sparkplugUInt16, sparkplugUInt32, sparkplugUInt64:
+		return raw.number, nil
+	case sparkplugFloat:
+		return math.Float32frombits(uint32(raw.number)), nil
+	case sparkplugDouble:
+		return math.Float64frombits(raw.number), nil
+	case sparkplugBoolean:
+		return raw.number != 0, nil
+	case sparkplugString, sparkplugText, sparkplugUUID:
+		return string(raw.bytes), nil
+	case sparkplugDateTime:
+		return time.UnixMilli(int64(raw.number)).UTC().Format(time.RFC3339Nano), nil
+	case sparkplugBytes, sparkplugFile:
+		return base64.StdEncoding.EncodeToString(raw.bytes), nil
+	case sparkplugDataSet:
+		return decodeSparkplugDataSet(raw.bytes)
+	case sparkplugTemplate:
+		return decodeSparkplugTemplate(raw.bytes)
+	}
+
+	if dataType >= sparkplugInt8Array && dataType <= sparkplugDateTimeArray {
+		return decodeSparkplugArray(dataType, raw.bytes)
+	}
+
+	// the metric did not say, so go by the field it used
+	switch raw.field {
+	case 10, 11:
+		return raw.number, nil
+	case 12:
+		return math.Float32frombits(uint32(raw.number)), nil
+	case 13:
+		return math.Float64frombits(raw.number), nil
+	case 14:
+		return raw.number != 0, nil
+	case 15:
+		return string(raw.bytes), nil
+	}
+
+	return base64.StdEncoding.EncodeToString(raw.bytes), nil
+}
+
+// Decodes a data set as one object per row, keyed by the column names.
+func decodeSparkplugDataSet(data []byte) (any, error) {
+	var columns []string
+	var types []uint32
+	var rows [][]sparkplugRawValue
+
+	err := walkProtobuf(data, func(field protowire.Number, wireType protowire.Type, value sparkplugRawValue) error {
+		switch field {
+		case 2:
+			columns = append(columns, string(value.bytes))
+		case 3:
+			if wireType != protowire.BytesType {
+				types = append(types, uint32(value.number))
+				return nil
+			}
+			// packed repeated field
+			for packed := value.bytes; len(packed) > 0; {
+				number, n := protowire.ConsumeVarint(packed)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				types = append(types, uint32(number))
+				packed = packed[n:]
+			}
+		case 4:
+			var row []sparkplugRawValue
+			err := walkProtobuf(value.bytes, func(field protowire.Number, wireType protowire.Type, element sparkplugRawValue) error {
+				if field != 1 {
+					return nil
+				}
+				return walkProtobuf(element.bytes, func(field protowire.Number, wireType protowire.Type, value sparkplugRawValue) error {
+					// data set values number their fields from 1, metrics from 10
+					value.field = field + 9
+					row = append(row, value)
+					return nil
+				})
+			})
+			if err != nil {
+				return err
+			}
+			rows = append(rows, row)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := []map[string]any{}
+	for _, row := range rows {
+		object := map[string]any{}
+		for i, element := range row {
+			if i >= len(columns) {
+				break
+			}
+			var dataType uint32
+			if i < len(types) {
+				dataType = types[i]
+			}
+			object[columns[i]], _ = SparkplugMetric{raw: element}.decodeValue(dataType)
+		}
+		decoded = append(decoded, object)
+	}
+
+	return decoded, nil
+}
+
+// Decodes a template instance as an object of its metric values.
+func decodeSparkplugTemplate(data []byte) (any, error) {
+	decoded := map[string]any{}
+
+	err := walkProtobuf(data, func(field protowire.Number, wireType protowire.Type, value sparkplugRawValue) error {
+		if field != 2 {
+			return nil
+		}
+		metric, err := decodeSparkplugMetric(value.bytes)
+		if err != nil {
+			return err
+		}
+		decoded[metric.Name] = metric.Value
+		return nil
+	})
+
+	return decoded, err
+}
+
+// Decodes the little endian array types carried in the bytes value.
+func decodeSparkplugArray(dataType uint32, data []byte) (any, error) {
+	sizes := map[uint32]int{
+		sparkplugInt8Array: 1, sparkplugUInt8Array: 1,
+		sparkplugInt16Array: 2, sparkplugUInt16Array: 2,
+		sparkplugInt32Array: 4, sparkplugUInt32Array: 4, sparkplugFloatArray: 4,
+		sparkplugInt64Array: 8, sparkplugUInt64Array: 8, sparkplugDoubleArray: 8, sparkplugDateTimeArray: 8,
+	}
+
+	switch dataType {
+	case sparkplugStringArray:
+		return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00"), nil
+	case sparkplugBooleanArray:
+		if len(data) < 4 {
+			return nil, errors.New("boolean array without a length")
+		}
+		count := int(binary.LittleEndian.Uint32(data))
+		if len(data) - 4 < (count + 7) / 8 {
+			return nil, errors.New("boolean array is too short")
+		}
+		values := make([]bool, count)
+		for i := range values {
+			values[i] = data[4 + i / 8] & (0x80 >> (i % 8)) != 0
+		}
+		return values, nil
+	}
+
+	size := sizes[dataType]
+	if size == 0 || len(data) % size != 0 {
+		return nil, fmt.Errorf("invalid %s value", sparkplugDataTypeName(dataType))
+	}
+
+	values := make([]any, 0, len(data) / size)
+	for i := 0; i < len(data); i += size {
+		var number uint64
+		switch size {
+		case 1:
+			number = uint64(data[i])
+		case 2:
+			number = uint64(binary.LittleEndian.Uint16(data[i:]))
+		case 4:
+			number = uint64(binary.LittleEndian.Uint32(data[i:]))
+		case 8:
+			number = binary.LittleEndian.Uint64(data[i:])
+		}
+
+		// the matching scalar type follows 21 places earlier
+		value, _ := SparkplugMetric{raw: sparkplugRawValue{field: 11, number: number}}.decodeValue(dataType - 21)
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// Calls fn for every field of a protobuf message. Varint and fixed width
+// values arrive in number, length delimited ones in bytes.
+func walkProtobuf(data []byte, fn func(field protowire.Number, wireType protowire.Type, value sparkplugRawValue) error) error {
+	for len(data) > 0 {
+		field, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		value := sparkplugRawValue{field: field}
+		switch wireType {
+		case protowire.VarintType:
+			value.number, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			var number uint32
+			number, n = protowire.ConsumeFixed32(data)
+			value.number = uint64(number)
+		case protowire.Fixed64Type:
+			value.number, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			value.bytes, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(field, wireType, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if err := fn(field, wireType, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Encodes a command payload setting one metric, the text is parsed according
+// to the data type of the metric.
+func encodeSparkplugCommand(name string, dataType uint32, text string) ([]byte, error) {
+	var metric []byte
+	metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+	metric = protowire.AppendString(metric, name)
+	metric = protowire.AppendTag(metric, 3, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, uint64(time.Now().UnixMilli()))
+	metric = protowire.AppendTag(metric, 4, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, uint64(dataType))
+
+	text = strings.TrimSpace(text)
+	switch dataType {
+	case sparkplugInt8, sparkplugInt16, sparkplugInt32, sparkplugInt64:
+		number, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid %s", text, sparkplugDataTypeName(dataType))
+		}
+		if dataType == sparkplugInt64 {
+			metric = appendSparkplugVarint(metric, 11, uint64(number))
+		} else {
+			metric = appendSparkplugVarint(metric, 10, uint64(uint32(int32(number))))
+		}
+	case sparkplugUInt8, sparkplugUInt16, sparkplugUInt32, sparkplugUInt64, sparkplugDateTime:
+		number, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid %s", text, sparkplugDataTypeName(dataType))
+		}
+		if dataType == sparkplugUInt64 || dataType == sparkplugDateTime {
+			metric = appendSparkplugVarint(metric, 11, number)
+		} else {
+			metric = appendSparkplugVarint(metric, 10, number)
+		}
+	case sparkplugFloat:
+		number, err := strconv.ParseFloat(text, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid Float", text)
+		}
+		metric = protowire.AppendTag(metric, 12, protowire.Fixed32Type)
+		metric = protowire.AppendFixed32(metric, math.Float32bits(float32(number)))
+	case sparkplugDouble:
+		number, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid Double", text)
+		}
+		metric = protowire.AppendTag(metric, 13, protowire.Fixed64Type)
+		metric = protowire.AppendFixed64(metric, math.Float64bits(number))
+	case sparkplugBoolean:
+		value, err := parseSparkplugBoolean(text)
+		if err != nil {
+			return nil, err
+		}
+		metric = appendSparkplugVarint(metric, 14, protowire.EncodeBool(value))
+	case sparkplugString, sparkplugText, sparkplugUUID:
+		metric = protowire.AppendTag(metric, 15, protowire.BytesType)
+		metric = protowire.AppendString(metric, text)
+	default:
+		return nil, fmt.Errorf("writing %s metrics is not supported", sparkplugDataTypeName(dataType))
+	}
+
+	var payload []byte
+	payload = appendSparkplugVarint(payload, 1, uint64(time.Now().UnixMilli()))
+	payload = protowire.AppendTag(payload, 2, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, metric)
+
+	return payload, nil
+}
+
+func appendSparkplugVarint(data []byte, field protowire.Number, value uint64) []byte {
+	data = protowire.AppendTag(data, field, protowire.VarintType)
+	return protowire.AppendVarint(data, value)
+}
+
+// Accepts the payloads buttons and switches usually publish.
+func parseSparkplugBoolean(text string) (bool, error) {
+	switch strings.ToLower(text) {
+	case "true", "1", "on":
+		return true, nil
+	case "false", "0", "off":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("%q is not a valid Boolean", text)
+}
+
+// Formats a metric value as the payload of its virtual topic, strings stay
+// unquoted.
+func sparkplugValueText(value any) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case nil:
+		return "null"
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		// NaN and infinite floats
+		return fmt.Sprint(value)
+	}
+
+	return string(encoded)
+}
+
+// sparkplugDecoder shows Sparkplug B payloads as JSON in the console and in
+// widgets on the raw spBv1.0 topics.
+type sparkplugDecoder struct{}
+
+func (sparkplugDecoder) Decode(payload []byte) (any, error) {
+	return decodeSparkplugPayload(payload)
+}
+
+func init() {
+	RegisterPayloadDecoder("sparkplug", func(project *Project, argument string) (PayloadDecoder, error) {
+		return sparkplugDecoder{}, nil
+	})
+}
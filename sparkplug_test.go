@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// NDATA payload with timestamp 1000, seq 2 and one metric with alias 1 and
+// the int value 42.
+const sparkplugNDATAFixture = "08e807" + "1204" + "1001" + "502a" + "1802"
+
+// Builds the Sparkplug B metric messages of the tests. Field numbers follow
+// sparkplug_b.proto: 1 name, 2 alias, 4 datatype and 10 to 18 the value.
+type sparkplugTestMetric struct {
+	name string
+	alias *uint64
+	dataType uint32
+	historical bool
+	value []byte // tag and value, see the sparkplugTest* value helpers
+}
+
+func (m sparkplugTestMetric) encode() []byte {
+	var data []byte
+	if m.name != "" {
+		data = protowire.AppendTag(data, 1, protowire.BytesType)
+		data = protowire.AppendString(data, m.name)
+	}
+	if m.alias != nil {
+		data = appendSparkplugVarint(data, 2, *m.alias)
+	}
+	if m.dataType != 0 {
+		data = appendSparkplugVarint(data, 4, uint64(m.dataType))
+	}
+	if m.historical {
+		data = appendSparkplugVarint(data, 5, 1)
+	}
+
+	return append(data, m.value...)
+}
+
+func sparkplugTestPayload(seq uint64, metrics ...sparkplugTestMetric) []byte {
+	payload := appendSparkplugVarint(nil, 1, 1700000000000)
+	for _, metric := range metrics {
+		payload = protowire.AppendTag(payload, 2, protowire.BytesType)
+		payload = protowire.AppendBytes(payload, metric.encode())
+	}
+
+	return appendSparkplugVarint(payload, 3, seq)
+}
+
+func sparkplugTestAlias(alias uint64) *uint64 {
+	return &alias
+}
+
+func sparkplugTestVarint(field protowire.Number, value uint64) []byte {
+	return appendSparkplugVarint(nil, field, value)
+}
+
+// Int8, Int16 and Int32 values are sent as the uint32 of their two's
+// complement.
+func sparkplugTestInt32(value int32) []byte {
+	return sparkplugTestVarint(10, uint64(uint32(value)))
+}
+
+func sparkplugTestInt64(value int64) []byte {
+	return sparkplugTestVarint(11, uint64(value))
+}
+
+func sparkplugTestBytes(field protowire.Number, value []byte) []byte {
+	data := protowire.AppendTag(nil, field, protowire.BytesType)
+	return protowire.AppendBytes(data, value)
+}
+
+func sparkplugTestDouble(value float64) []byte {
+	data := protowire.AppendTag(nil, 13, protowire.Fixed64Type)
+	return protowire.AppendFixed64(data, math.Float64bits(value))
+}
+
+func TestDecodeSparkplugPayloadFixture(t *testing.T) {
+	data, err := hex.DecodeString(sparkplugNDATAFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := decodeSparkplugPayload(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Timestamp != 1000 || payload.Seq == nil || *payload.Seq != 2 {
+		t.Errorf("got timestamp %d and seq %v, want 1000 and 2", payload.Timestamp, payload.Seq)
+	}
+	if len(payload.Metrics) != 1 {
+		t.Fatalf("got %d metrics, want 1", len(payload.Metrics))
+	}
+
+	metric := payload.Metrics[0]
+	if metric.Name != "" || metric.Alias == nil || *metric.Alias != 1 {
+		t.Errorf("got name %q and alias %v, want alias 1 only", metric.Name, metric.Alias)
+	}
+	// without a data type the value goes by its field
+	if metric.Value != uint64(42) {
+		t.Errorf("got value %#v, want 42", metric.Value)
+	}
+}
+
+func TestDecodeSparkplugMetricValues(t *testing.T) {
+	int16Array := binary.LittleEndian.AppendUint16(nil, uint16(0xfffe))
+	int16Array = binary.LittleEndian.AppendUint16(int16Array, 300)
+
+	booleanArray := binary.LittleEndian.AppendUint32(nil, 3)
+	booleanArray = append(booleanArray, 0b10100000)
+
+	// two columns of the types Int32 and String, one row
+	var dataSet []byte
+	dataSet = appendSparkplugVarint(dataSet, 1, 2)
+	dataSet = append(dataSet, sparkplugTestBytes(2, []byte("id"))...)
+	dataSet = append(dataSet, sparkplugTestBytes(2, []byte("name"))...)
+	dataSet = append(dataSet, sparkplugTestBytes(3, []byte{byte(sparkplugInt32), byte(sparkplugString)})...)
+	var row []byte
+	row = append(row, sparkplugTestBytes(1, sparkplugTestVarint(1, 7))...)
+	row = append(row, sparkplugTestBytes(1, sparkplugTestBytes(6, []byte("pump")))...)
+	dataSet = append(dataSet, sparkplugTestBytes(4, row)...)
+
+	template := sparkplugTestBytes(2, sparkplugTestMetric{
+		name: "Speed",
+		dataType: sparkplugInt32,
+		value: sparkplugTestVarint(10, 1200),
+	}.encode())
+
+	tests := []struct {
+		name string
+		dataType uint32
+		value []byte
+		want any
+	}{
+		{"Int8", sparkplugInt8, sparkplugTestInt32(-5), int8(-5)},
+		{"Int16", sparkplugInt16, sparkplugTestInt32(-300), int16(-300)},
+		{"Int32", sparkplugInt32, sparkplugTestInt32(-70000), int32(-70000)},
+		{"Int64", sparkplugInt64, sparkplugTestInt64(-5000000000), int64(-5000000000)},
+		{"UInt32", sparkplugUInt32, sparkplugTestVarint(10, 4000000000), uint64(4000000000)},
+		{"Float", sparkplugFloat, protowire.AppendFixed32(protowire.AppendTag(nil, 12, protowire.Fixed32Type), math.Float32bits(1.5)), float32(1.5)},
+		{"Double", sparkplugDouble, sparkplugTestDouble(21.25), 21.25},
+		{"Boolean", sparkplugBoolean, sparkplugTestVarint(14, 1), true},
+		{"String", sparkplugString, sparkplugTestBytes(15, []byte("running")), "running"},
+		{"DateTime", sparkplugDateTime, sparkplugTestVarint(11, 1700000000000), "2023-11-14T22:13:20Z"},
+		{"Bytes", sparkplugBytes, sparkplugTestBytes(16, []byte{1, 2, 3}), "AQID"},
+		{"Int16Array", sparkplugInt16Array, sparkplugTestBytes(16, int16Array), []any{int16(-2), int16(300)}},
+		{"BooleanArray", sparkplugBooleanArray, sparkplugTestBytes(16, booleanArray), []bool{true, false, true}},
+		{"StringArray", sparkplugStringArray, sparkplugTestBytes(16, []byte("a\x00bc\x00")), []string{"a", "bc"}},
+		{"DataSet", sparkplugDataSet, sparkplugTestBytes(17, dataSet), []map[string]any{{"id": int32(7), "name": "pump"}}},
+		{"Template", sparkplugTemplate, sparkplugTestBytes(18, template), map[string]any{"Speed": int32(1200)}},
+	}
+
+	for _, test := range tests {
+		metric, err := decodeSparkplugMetric(sparkplugTestMetric{
+			name: test.name,
+			dataType: test.dataType,
+			value: test.value,
+		}.encode())
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(metric.Value, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, metric.Value, test.want)
+		}
+	}
+}
+
+func TestDecodeSparkplugMalformed(t *testing.T) {
+	fixture, err := hex.DecodeString(sparkplugNDATAFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated varint", fixture[:2]},
+		{"truncated metric", fixture[:6]},
+		{"invalid tag", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"field number 0", []byte{0x00, 0x01}},
+		{"metric longer than the payload", []byte{0x12, 0x10, 0x10, 0x01}},
+		{"malformed metric", sparkplugTestBytes(2, []byte{0x0a, 0x05, 'a'})},
+	}
+
+	for _, test := range tests {
+		if _, err := decodeSparkplugPayload(test.data); err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+}
+
+func TestDecodeSparkplugArrayMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		dataType uint32
+		data []byte
+	}{
+		{"Int32Array of 3 bytes", sparkplugInt32Array, []byte{1, 2, 3}},
+		{"DoubleArray of 12 bytes", sparkplugDoubleArray, make([]byte, 12)},
+		{"BooleanArray without a length", sparkplugBooleanArray, []byte{1, 0}},
+		{"BooleanArray shorter than its length", sparkplugBooleanArray, []byte{9, 0, 0, 0, 0xff}},
+	}
+
+	for _, test := range tests {
+		if _, err := decodeSparkplugArray(test.dataType, test.data); err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+}
+
+func TestEncodeSparkplugCommandRoundTrip(t *testing.T) {
+	tests := []struct {
+		dataType uint32
+		text string
+		want any
+	}{
+		{sparkplugInt8, "-5", int8(-5)},
+		{sparkplugInt16, "-300", int16(-300)},
+		{sparkplugInt32, "-70000", int32(-70000)},
+		{sparkplugInt64, "-5000000000", int64(-5000000000)},
+		{sparkplugUInt16, "7", uint64(7)},
+		{sparkplugUInt64, "18446744073709551615", uint64(math.MaxUint64)},
+		{sparkplugFloat, "1.5", float32(1.5)},
+		{sparkplugDouble, " 2.25 ", 2.25},
+		{sparkplugBoolean, "on", true},
+		{sparkplugBoolean, "0", false},
+		{sparkplugString, "hello", "hello"},
+		{sparkplugDateTime, "1700000000000", "2023-11-14T22:13:20Z"},
+	}
+
+	for _, test := range tests {
+		name := sparkplugDataTypeName(test.dataType)
+		data, err := encodeSparkplugCommand("Node Control/Value", test.dataType, test.text)
+		if err != nil {
+			t.Errorf("%s %q: %v", name, test.text, err)
+			continue
+		}
+
+		payload, err := decodeSparkplugPayload(data)
+		if err != nil {
+			t.Errorf("%s %q: %v", name, test.text, err)
+			continue
+		}
+		if payload.Timestamp == 0 || len(payload.Metrics) != 1 {
+			t.Errorf("%s %q: got timestamp %d and %d metrics", name, test.text, payload.Timestamp, len(payload.Metrics))
+			continue
+		}
+
+		metric := payload.Metrics[0]
+		if metric.Name != "Node Control/Value" || metric.DataType != test.dataType {
+			t.Errorf("%s %q: got name %q and data type %d", name, test.text, metric.Name, metric.DataType)
+		}
+		if !reflect.DeepEqual(metric.Value, test.want) {
+			t.Errorf("%s %q: got %#v, want %#v", name, test.text, metric.Value, test.want)
+		}
+	}
+}
+
+func TestEncodeSparkplugCommandErrors(t *testing.T) {
+	tests := []struct {
+		dataType uint32
+		text string
+		err string
+	}{
+		{sparkplugInt32, "x", "is not a valid Int32"},
+		{sparkplugUInt8, "-1", "is not a valid UInt8"},
+		{sparkplugDouble, "warm", "is not a valid Double"},
+		{sparkplugBoolean, "maybe", "is not a valid Boolean"},
+		{sparkplugDataSet, "[]", "not supported"},
+	}
+
+	for _, test := range tests {
+		_, err := encodeSparkplugCommand("Value", test.dataType, test.text)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s %q: got error %v, want %q", sparkplugDataTypeName(test.dataType), test.text, err, test.err)
+		}
+	}
+}
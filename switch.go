@@ -0,0 +1,347 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const DefaultSwitchTimeout int = 5 // seconds
+
+// switchCommand is the last state a SWITCH widget asked for, it is pending
+// until the state topic confirms it or the timeout elapses. Confirmed
+// commands are removed, the ones left after the timeout were never confirmed.
+type switchCommand struct {
+	On bool
+	SentAt time.Time
+	Timeout time.Duration
+}
+
+// SwitchWidgetData is the confirmed state of the device, Known is false
+// while the state topic sent nothing or a value matching neither state.
+type SwitchWidgetData struct {
+	Known bool
+	On bool
+	Value string
+	Pending bool
+	Target bool // state asked for while pending
+	TimedOut bool // the last command was never confirmed
+}
+
+// Reads the switch specific fields of the widget forms.
+func parseSwitchForm(r *http.Request) (SwitchWidgetConfig, error) {
+	config := SwitchWidgetConfig{
+		PayloadOn: r.FormValue("payload-on"),
+		PayloadOff: r.FormValue("payload-off"),
+		StateTopic: strings.TrimSpace(r.FormValue("state-topic")),
+		StateOn: strings.TrimSpace(r.FormValue("state-on")),
+		StateOff: strings.TrimSpace(r.FormValue("state-off")),
+	}
+
+	if config.PayloadOn == "" {
+		config.PayloadOn = "ON"
+	}
+	if config.PayloadOff == "" {
+		config.PayloadOff = "OFF"
+	}
+	if config.StateOn == "" {
+		config.StateOn = config.PayloadOn
+	}
+
+	timeout, err := parseNumberField(r.FormValue("timeout"), float64(DefaultSwitchTimeout))
+	if err != nil || timeout != math.Trunc(timeout) || timeout < 1 {
+		return config, fmt.Errorf("timeout must be at least 1 second")
+	}
+	config.Timeout = int(timeout)
+
+	if config.StateTopic != "" {
+		if err := validatePublishTopic(config.StateTopic); err != nil {
+			return config, fmt.Errorf("invalid state topic: %w", err)
+		}
+	}
+
+	return config, nil
+}
+
+// Parses the value published by the dashboard, "on" or "off".
+func parseSwitchValue(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "on", "true", "1":
+		return true, nil
+	case "off", "false", "0":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("invalid switch value %q, must be on or off", value)
+}
+
+// Publishes the payload of the state and records the command, so the
+// widget shows it pending.
+func sendSwitchCommand(connection *Connection, projectWidget ProjectWidget, config SwitchWidgetConfig, value string) error {
+	on, err := parseSwitchValue(value)
+	if err != nil {
+		return err
+	}
+
+	payload := config.PayloadOff
+	if on {
+		payload = config.PayloadOn
+	}
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Duration(DefaultSwitchTimeout) * time.Second
+	}
+
+	// recorded first, the state may arrive before SendMessage returns
+	connection.setSwitchCommand(projectWidget.ID, &switchCommand{
+		On: on,
+		SentAt: time.Now(),
+		Timeout: timeout,
+	})
+
+	err = connection.SendMessage(Message{
+		Topic: config.Topic,
+		Payload: []byte(payload),
+		QoS: config.QoS,
+		Retained: config.Retain,
+		Properties: config.MessageProperties(),
+	})
+	if err != nil {
+		connection.setSwitchCommand(projectWidget.ID, nil)
+		return err
+	}
+
+	// listeners redraw the widget once the command expired
+	time.AfterFunc(timeout, func() {
+		connection.mutex.Lock()
+		defer connection.mutex.Unlock()
+
+		connection.notify(ConnectionEvent{
+			Type: EventSwitch,
+			WidgetID: projectWidget.ID,
+		})
+	})
+
+	return nil
+}
+
+// Stores the command of the widget, nil removes it, and tells listeners
+// about it.
+func (c *Connection) setSwitchCommand(widgetID int, command *switchCommand) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.switchCommands == nil {
+		c.switchCommands = make(map[int]switchCommand)
+	}
+	if command == nil {
+		delete(c.switchCommands, widgetID)
+	} else {
+		c.switchCommands[widgetID] = *command
+	}
+
+	c.notify(ConnectionEvent{
+		Type: EventSwitch,
+		WidgetID: widgetID,
+	})
+}
+
+// Removes the command of the widget once confirmed, unless a newer command
+// replaced it meanwhile.
+func (c *Connection) confirmSwitchCommand(widgetID int, command switchCommand) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if current, found := c.switchCommands[widgetID]; found && current == command {
+		delete(c.switchCommands, widgetID)
+	}
+}
+
+func (c *Connection) SwitchCommand(widgetID int) (switchCommand, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	command, found := c.switchCommands[widgetID]
+	return command, found
+}
+
+// Matches the value of the state topic against the state rules, a value
+// matching neither leaves the state unknown. Without an OFF rule every value
+// that is not ON is OFF.
+func (c SwitchWidgetConfig) State(topic string, value string) (known bool, on bool, err error) {
+	on, err = indicatorState(c.StateOn, topic, value)
+	if err != nil || on {
+		return err == nil, on, err
+	}
+
+	if c.StateOff == "" {
+		return true, false, nil
+	}
+
+	off, err := indicatorState(c.StateOff, topic, value)
+	if err != nil {
+		return false, false, err
+	}
+
+	return off, false, nil
+}
+
+// Builds the state shown by the widget from the state topic and the last
+// command. Without a state topic the last command is all that is known.
+func getSwitchData(connection *Connection, decoders *PayloadDecoders, projectWidget ProjectWidget, config SwitchWidgetConfig, transform *Expression) (*SwitchWidgetData, error) {
+	var data *SwitchWidgetData
+
+	if config.StateTopic != "" {
+		if message, found := connection.LatestMessage(config.StateTopic); found {
+			value, err := decodeValue(decoders, message.Topic, message.Payload, config.ValuePath, transform)
+			if err != nil {
+				return nil, err
+			}
+
+			known, on, err := config.State(message.Topic, value)
+			if err != nil {
+				return nil, err
+			}
+
+			data = &SwitchWidgetData{
+				Known: known,
+				On: on,
+				Value: value,
+			}
+		}
+	}
+
+	command, found := connection.SwitchCommand(projectWidget.ID)
+	if !found {
+		return data, nil
+	}
+
+	if config.StateTopic == "" {
+		return &SwitchWidgetData{
+			Known: true,
+			On: command.On,
+		}, nil
+	}
+
+	// any state since the command that matches it confirms it, even when the
+	// device reported another state afterwards
+	for _, message := range connection.Messages(config.StateTopic) {
+		if message.ReceivedAt.Before(command.SentAt) {
+			continue
+		}
+
+		value, err := decodeValue(decoders, message.Topic, message.Payload, config.ValuePath, transform)
+		if err != nil {
+			continue
+		}
+		if known, on, err := config.State(message.Topic, value); err == nil && known && on == command.On {
+			connection.confirmSwitchCommand(projectWidget.ID, command)
+			return data, nil
+		}
+	}
+
+	if data == nil {
+		data = &SwitchWidgetData{}
+	}
+
+	if time.Since(command.SentAt) < command.Timeout {
+		data.Pending = true
+		data.Target = command.On
+	} else {
+		data.TimedOut = true
+	}
+
+	return data, nil
+}
+
+// Publishes the state of a SWITCH widget like projectSubmitValueHandler and
+// answers with the widget data instead of redirecting.
+func projectSwitchHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST method is supported.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "ERROR: invalid widget ID", http.StatusBadRequest)
+			return
+		}
+
+		projectWidgets, err := getProjectWidgets(db, project.ID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		var projectWidget ProjectWidget
+		for _, candidate := range projectWidgets {
+			if candidate.ID == id && candidate.Widget == "SWITCH" {
+				projectWidget = candidate
+			}
+		}
+		if projectWidget.ID == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		connection := connections.Get(project.ID)
+		if connection == nil {
+			http.Error(w, "ERROR: not connected to the broker", http.StatusBadGateway)
+			return
+		}
+
+		decoders, err := newPayloadDecoders(project)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := parseSwitchValue(r.FormValue("value")); err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := publishWidgetValue(connection, projectWidget, r.FormValue("value")); err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		widgetData, err := getWidgetData(db, connection, decoders, projectWidget)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		resp, err := json.Marshal(widgetData)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	}
+}
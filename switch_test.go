@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetSwitchData(t *testing.T) {
+	sentAt := time.Now().Add(-time.Minute)
+	config := SwitchWidgetConfig{StateTopic: "plug/state", StateOn: "ON", StateOff: "OFF"}
+
+	// states received this long after the command, negative ones before it
+	tests := []struct {
+		name string
+		timeout time.Duration
+		states []string
+		offsets []time.Duration
+		want SwitchWidgetData
+		wantCommand bool
+	}{
+		{"confirmed", time.Second, []string{"ON"}, []time.Duration{time.Second},
+			SwitchWidgetData{Known: true, On: true, Value: "ON"}, false},
+		{"changed on the device after confirming", time.Second, []string{"ON", "OFF"}, []time.Duration{time.Second, 30 * time.Second},
+			SwitchWidgetData{Known: true, On: false, Value: "OFF"}, false},
+		{"never confirmed", time.Second, []string{"OFF"}, []time.Duration{time.Second},
+			SwitchWidgetData{Known: true, On: false, Value: "OFF", TimedOut: true}, true},
+		{"confirmed before the command", time.Second, []string{"ON", "OFF"}, []time.Duration{-time.Second, 0},
+			SwitchWidgetData{Known: true, On: false, Value: "OFF", TimedOut: true}, true},
+		{"pending without a state", time.Hour, nil, nil,
+			SwitchWidgetData{Pending: true, Target: true}, true},
+		{"pending with another state", time.Hour, []string{"OFF"}, []time.Duration{time.Second},
+			SwitchWidgetData{Known: true, On: false, Value: "OFF", Pending: true, Target: true}, true},
+	}
+
+	for _, test := range tests {
+		command := switchCommand{On: true, SentAt: sentAt, Timeout: test.timeout}
+		connection := &Connection{
+			DataBuffer: map[string]*TopicBuffer{"plug/state": NewTopicBuffer(10, 0)},
+			switchCommands: map[int]switchCommand{1: command},
+		}
+		for i, state := range test.states {
+			connection.DataBuffer["plug/state"].Push(Message{
+				Topic: "plug/state",
+				Payload: []byte(state),
+				ReceivedAt: sentAt.Add(test.offsets[i]),
+			})
+		}
+
+		data, err := getSwitchData(connection, nil, ProjectWidget{ID: 1}, config, nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if data == nil || *data != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, data, test.want)
+		}
+		if _, found := connection.SwitchCommand(1); found != test.wantCommand {
+			t.Errorf("%s: got command %v, want %v", test.name, found, test.wantCommand)
+		}
+	}
+}
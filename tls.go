@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// Builds the TLS configuration used for ssl:// and wss:// brokers from the
+// certificates uploaded in the project settings.
+func newTLSConfig(project *Project) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: project.TLSServerName,
+		InsecureSkipVerify: project.TLSInsecureSkipVerify,
+	}
+
+	if len(project.TLSCACert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(project.TLSCACert) {
+			return nil, errors.New("CA bundle does not contain any PEM certificates")
+		}
+		config.RootCAs = pool
+	}
+
+	if len(project.TLSClientCert) > 0 || len(project.TLSClientKey) > 0 {
+		if len(project.TLSClientKey) == 0 && project.TLSClientKeyLost {
+			return nil, errors.New("the stored client key could not be decrypted, upload it again or remove the client certificate")
+		}
+		if len(project.TLSClientCert) == 0 || len(project.TLSClientKey) == 0 {
+			return nil, errors.New("client certificate and client key must be uploaded together")
+		}
+
+		certificate, err := tls.X509KeyPair(project.TLSClientCert, project.TLSClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// Reads an uploaded file from a multipart form, returns nil when the field
+// was left empty.
+func readUploadedFile(r *http.Request, name string) ([]byte, error) {
+	file, _, err := r.FormFile(name)
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
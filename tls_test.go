@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Certificate and PEM encoded key signed by the parent, or self-signed
+// without a parent.
+type testCertificate struct {
+	template *x509.Certificate
+	key *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM []byte
+}
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.template, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{
+		template: template,
+		key: key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// Starts a TLS listener standing in for the broker. It requires a client
+// certificate signed by the CA and reports the result of each handshake.
+func startTestTLSBroker(t *testing.T, ca *testCertificate, server *testCertificate) (string, <-chan error) {
+	t.Helper()
+
+	certificate, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(ca.certPEM)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	handshakes := make(chan error, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			handshakes <- conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	return listener.Addr().String(), handshakes
+}
+
+func TestNewTLSConfigHandshake(t *testing.T) {
+	ca := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "Test CA"},
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject: pkix.Name{CommonName: "broker.test"},
+		DNSNames: []string{"broker.test"},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject: pkix.Name{CommonName: "mqttstudio"},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	address, handshakes := startTestTLSBroker(t, ca, server)
+
+	tests := []struct {
+		name string
+		project Project
+		ok bool
+	}{
+		{"CA and client certificate", Project{
+			TLSCACert: ca.certPEM,
+			TLSClientCert: client.certPEM,
+			TLSClientKey: client.keyPEM,
+			TLSServerName: "broker.test",
+		}, true},
+		{"hostname mismatch", Project{
+			TLSCACert: ca.certPEM,
+			TLSClientCert: client.certPEM,
+			TLSClientKey: client.keyPEM,
+			TLSServerName: "other.test",
+		}, false},
+		{"unknown CA", Project{
+			TLSClientCert: client.certPEM,
+			TLSClientKey: client.keyPEM,
+			TLSServerName: "broker.test",
+		}, false},
+		{"insecure skip verify", Project{
+			TLSClientCert: client.certPEM,
+			TLSClientKey: client.keyPEM,
+			TLSServerName: "other.test",
+			TLSInsecureSkipVerify: true,
+		}, true},
+		{"without client certificate", Project{
+			TLSCACert: ca.certPEM,
+			TLSServerName: "broker.test",
+		}, false},
+	}
+
+	for _, test := range tests {
+		config, err := newTLSConfig(&test.project)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		conn, err := tls.Dial("tcp", address, config)
+		if err == nil {
+			// the broker verifies the client certificate after the client
+			// finished, its result is the one of the handshake
+			err = <-handshakes
+			conn.Close()
+		} else {
+			<-handshakes
+		}
+
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	client := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "mqttstudio"},
+	}, nil)
+
+	tests := []struct {
+		name string
+		project Project
+	}{
+		{"CA bundle without certificates", Project{TLSCACert: []byte("not a certificate")}},
+		{"client certificate without key", Project{TLSClientCert: client.certPEM}},
+		{"client key without certificate", Project{TLSClientKey: client.keyPEM}},
+		{"mismatched key", Project{TLSClientCert: client.certPEM, TLSClientKey: client.certPEM}},
+	}
+
+	for _, test := range tests {
+		if _, err := newTLSConfig(&test.project); err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+}
+
+func TestReadUploadedFile(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("tls-ca-cert", "ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("certificate"))
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+
+	data, err := readUploadedFile(r, "tls-ca-cert")
+	if err != nil || string(data) != "certificate" {
+		t.Errorf("got %q, %v, want the uploaded file", data, err)
+	}
+
+	// fields left empty keep the stored file
+	data, err = readUploadedFile(r, "tls-client-cert")
+	if err != nil || data != nil {
+		t.Errorf("got %q, %v for an empty field, want nil", data, err)
+	}
+}
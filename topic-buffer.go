@@ -0,0 +1,90 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	DefaultBufferDepth int = 100
+)
+
+type Message struct {
+	Topic string
+	Payload []byte
+	QoS byte
+	Retained bool
+	Properties *MessageProperties // MQTT 5 only
+	ReceivedAt time.Time
+}
+
+// TopicBuffer keeps the most recent messages of a topic in a fixed size ring,
+// optionally also limited by the total payload size. It is not safe for
+// concurrent use, Connection guards it with its mutex.
+type TopicBuffer struct {
+	messages []Message
+	start int
+	count int
+	bytes int
+	maxBytes int
+}
+
+type BufferUsage struct {
+	Topics int
+	Messages int
+	Bytes int
+}
+
+// Creates a buffer that holds up to depth messages, maxBytes of 0 disables
+// the size limit.
+func NewTopicBuffer(depth int, maxBytes int) *TopicBuffer {
+	if depth < 1 {
+		depth = DefaultBufferDepth
+	}
+
+	return &TopicBuffer{
+		messages: make([]Message, depth),
+		maxBytes: maxBytes,
+	}
+}
+
+func (b *TopicBuffer) Push(message Message) {
+	// drop the oldest messages until the new one fits
+	for b.count > 0 && (b.count == len(b.messages) || (b.maxBytes > 0 && b.bytes + len(message.Payload) > b.maxBytes)) {
+		b.bytes -= len(b.messages[b.start].Payload)
+		b.messages[b.start] = Message{}
+		b.start = (b.start + 1) % len(b.messages)
+		b.count--
+	}
+
+	b.messages[(b.start + b.count) % len(b.messages)] = message
+	b.count++
+	b.bytes += len(message.Payload)
+}
+
+// Returns the most recently pushed message.
+func (b *TopicBuffer) Latest() (Message, bool) {
+	if b.count == 0 {
+		return Message{}, false
+	}
+
+	return b.messages[(b.start + b.count - 1) % len(b.messages)], true
+}
+
+// Returns the buffered messages, oldest first.
+func (b *TopicBuffer) Messages() []Message {
+	messages := make([]Message, 0, b.count)
+	for i := 0; i < b.count; i++ {
+		messages = append(messages, b.messages[(b.start + i) % len(b.messages)])
+	}
+
+	return messages
+}
+
+func (b *TopicBuffer) Len() int {
+	return b.count
+}
+
+// Returns the payload bytes currently held by the buffer.
+func (b *TopicBuffer) Bytes() int {
+	return b.bytes
+}
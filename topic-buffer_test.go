@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Pushes one message per payload.
+func pushTestMessages(buffer *TopicBuffer, payloads ...string) {
+	for _, payload := range payloads {
+		buffer.Push(Message{Topic: "home/t", Payload: []byte(payload)})
+	}
+}
+
+func bufferedPayloads(buffer *TopicBuffer) []string {
+	payloads := []string{}
+	for _, message := range buffer.Messages() {
+		payloads = append(payloads, string(message.Payload))
+	}
+
+	return payloads
+}
+
+func TestTopicBufferOverflow(t *testing.T) {
+	buffer := NewTopicBuffer(3, 0)
+	pushTestMessages(buffer, "1", "2")
+
+	if got := bufferedPayloads(buffer); !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Errorf("got %v before the buffer is full", got)
+	}
+
+	// wraps around twice, the oldest messages are dropped
+	pushTestMessages(buffer, "3", "4", "5", "6", "7")
+
+	if got := bufferedPayloads(buffer); !reflect.DeepEqual(got, []string{"5", "6", "7"}) {
+		t.Errorf("got %v, want the last 3 messages oldest first", got)
+	}
+	if buffer.Len() != 3 || buffer.Bytes() != 3 {
+		t.Errorf("got %d messages of %d bytes, want 3 of 3", buffer.Len(), buffer.Bytes())
+	}
+
+	latest, found := buffer.Latest()
+	if !found || string(latest.Payload) != "7" {
+		t.Errorf("got latest %q, %v, want 7", latest.Payload, found)
+	}
+}
+
+func TestTopicBufferLatest(t *testing.T) {
+	buffer := NewTopicBuffer(2, 0)
+
+	if _, found := buffer.Latest(); found {
+		t.Error("got a latest message of an empty buffer")
+	}
+	if got := bufferedPayloads(buffer); len(got) != 0 {
+		t.Errorf("got %v, want no messages", got)
+	}
+
+	for _, payload := range []string{"a", "b", "c", "d", "e"} {
+		pushTestMessages(buffer, payload)
+
+		latest, found := buffer.Latest()
+		if !found || string(latest.Payload) != payload {
+			t.Errorf("got latest %q after pushing %q", latest.Payload, payload)
+		}
+	}
+}
+
+func TestTopicBufferCapacityOne(t *testing.T) {
+	buffer := NewTopicBuffer(1, 0)
+	pushTestMessages(buffer, "first", "second", "third")
+
+	if got := bufferedPayloads(buffer); !reflect.DeepEqual(got, []string{"third"}) {
+		t.Errorf("got %v, want only the last message", got)
+	}
+	if buffer.Len() != 1 || buffer.Bytes() != len("third") {
+		t.Errorf("got %d messages of %d bytes, want 1 of %d", buffer.Len(), buffer.Bytes(), len("third"))
+	}
+}
+
+func TestTopicBufferMaxBytes(t *testing.T) {
+	buffer := NewTopicBuffer(10, 6)
+	pushTestMessages(buffer, "aa", "bb", "cc")
+
+	// the oldest messages make room for the new one
+	pushTestMessages(buffer, "ddd")
+	if got := bufferedPayloads(buffer); !reflect.DeepEqual(got, []string{"cc", "ddd"}) || buffer.Bytes() != 5 {
+		t.Errorf("got %v of %d bytes, want [cc ddd] of 5", got, buffer.Bytes())
+	}
+
+	// a message larger than the limit is kept on its own
+	pushTestMessages(buffer, "eeeeeeee")
+	if got := bufferedPayloads(buffer); !reflect.DeepEqual(got, []string{"eeeeeeee"}) || buffer.Bytes() != 8 {
+		t.Errorf("got %v of %d bytes, want only the large message", got, buffer.Bytes())
+	}
+}
+
+func TestNewTopicBufferDefaultDepth(t *testing.T) {
+	for _, depth := range []int{0, -1} {
+		buffer := NewTopicBuffer(depth, 0)
+		for i := 0; i < DefaultBufferDepth + 5; i++ {
+			pushTestMessages(buffer, "x")
+		}
+
+		if buffer.Len() != DefaultBufferDepth {
+			t.Errorf("depth %d: got %d messages, want %d", depth, buffer.Len(), DefaultBufferDepth)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Wildcards in topic filters must fill a whole level, "#" only the last one.
+func validateTopicFilter(filter string) error {
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i == len(levels) - 1 {
+			continue
+		}
+		if level == "+" {
+			continue
+		}
+		if strings.ContainsAny(level, "+#") {
+			return fmt.Errorf("invalid topic filter %q", filter)
+		}
+	}
+
+	return nil
+}
+
+func isTopicFilter(topic string) bool {
+	return strings.ContainsAny(topic, "+#")
+}
+
+// Reports whether the topic matches the filter the way the broker matches
+// subscriptions, wildcards at the first level skip topics starting with "$".
+func topicMatches(filter string, topic string) bool {
+	if filter == topic {
+		return true
+	}
+
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			// also matches the parent level, "a/#" matches "a"
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// Returns the literal part of the filter before the first wildcard, every
+// matching topic starts with it.
+func topicFilterPrefix(filter string) string {
+	if i := strings.IndexAny(filter, "+#"); i >= 0 {
+		return filter[:i]
+	}
+
+	return filter
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic string
+		want bool
+	}{
+		{"home/t", "home/t", true},
+		{"home/t", "home/h", false},
+		{"home/t", "home/t/x", false},
+		{"home", "home/", false},
+
+		// + fills exactly one level
+		{"home/+", "home/t", true},
+		{"home/+", "home/t/x", false},
+		{"home/+", "home", false},
+		{"+/+/temp", "a/b/temp", true},
+		{"+/+/temp", "a/temp", false},
+		{"home/+/temp", "home/kitchen/temp", true},
+		{"home/+/temp", "home/kitchen/hum", false},
+
+		// # fills the remaining levels and the parent
+		{"#", "home/t", true},
+		{"#", "/", true},
+		{"home/#", "home", true},
+		{"home/#", "home/t/x", true},
+		{"home/#", "homes/t", false},
+		{"home/+/#", "home/t", true},
+		{"home/+/#", "home", false},
+
+		// empty levels are levels
+		{"a//b", "a//b", true},
+		{"a/+/b", "a//b", true},
+		{"+", "/", false},
+		{"+/+", "/", true},
+		{"/#", "/a", true},
+		{"/#", "a", false},
+
+		// wildcards at the first level skip $ topics
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+		{"a/#", "a/$b", true},
+	}
+
+	for _, test := range tests {
+		if got := topicMatches(test.filter, test.topic); got != test.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	valid := []string{"home/t", "#", "+", "home/#", "home/+/temp", "+/+/#", "a//b", "/", "$SYS/#"}
+	for _, filter := range valid {
+		if err := validateTopicFilter(filter); err != nil {
+			t.Errorf("%q: %v", filter, err)
+		}
+	}
+
+	invalid := []string{"a/#/b", "#/a", "a+", "a/b+", "+a/b", "a/#b", "a#", "##", "a/++"}
+	for _, filter := range invalid {
+		if err := validateTopicFilter(filter); err == nil {
+			t.Errorf("%q: got no error", filter)
+		}
+	}
+}
+
+func TestTopicFilterPrefix(t *testing.T) {
+	tests := []struct {
+		filter string
+		want string
+	}{
+		{"home/t", "home/t"},
+		{"home/+/temp", "home/"},
+		{"home/#", "home/"},
+		{"#", ""},
+	}
+
+	for _, test := range tests {
+		if got := topicFilterPrefix(test.filter); got != test.want {
+			t.Errorf("topicFilterPrefix(%q) = %q, want %q", test.filter, got, test.want)
+		}
+		if got := isTopicFilter(test.filter); got != (test.want != test.filter) {
+			t.Errorf("isTopicFilter(%q) = %v", test.filter, got)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	rateWindow int64 = 10 // seconds
+)
+
+// TopicTree counts the messages of every topic level seen on the broker. It
+// is not safe for concurrent use, Connection guards it with its mutex.
+type TopicTree struct {
+	root *topicNode
+}
+
+type topicNode struct {
+	children map[string]*topicNode
+	messages int // including all sub topics
+	topicMessages int // published to exactly this topic
+	lastPayload []byte
+	lastSeen time.Time
+	rate rateCounter
+}
+
+// rateCounter counts messages in one second buckets over the last
+// rateWindow seconds.
+type rateCounter struct {
+	counts [rateWindow]int
+	seconds [rateWindow]int64
+}
+
+// TopicTreeNode is a snapshot of a tree level, as shown by the explorer.
+type TopicTreeNode struct {
+	Name string
+	Topic string
+	Messages int
+	TopicMessages int
+	LastPayload string
+	LastSeen time.Time
+	Rate float64 // messages per second
+	Children []TopicTreeNode
+}
+
+func NewTopicTree() *TopicTree {
+	return &TopicTree{
+		root: &topicNode{},
+	}
+}
+
+// Counts the message on every level of its topic.
+func (t *TopicTree) Add(message Message) {
+	node := t.root
+	for _, level := range strings.Split(message.Topic, "/") {
+		child, found := node.children[level]
+		if !found {
+			if node.children == nil {
+				node.children = make(map[string]*topicNode)
+			}
+			child = &topicNode{}
+			node.children[level] = child
+		}
+
+		child.messages++
+		child.lastSeen = message.ReceivedAt
+		child.rate.add(message.ReceivedAt)
+		node = child
+	}
+
+	node.topicMessages++
+	node.lastPayload = message.Payload
+}
+
+// Returns the top level nodes sorted by name.
+func (t *TopicTree) Snapshot(now time.Time) []TopicTreeNode {
+	return t.root.snapshot(nil, now)
+}
+
+func (n *topicNode) snapshot(levels []string, now time.Time) []TopicTreeNode {
+	nodes := []TopicTreeNode{}
+	for name, child := range n.children {
+		path := append(slices.Clip(levels), name)
+
+		nodes = append(nodes, TopicTreeNode{
+			Name: name,
+			Topic: strings.Join(path, "/"),
+			Messages: child.messages,
+			TopicMessages: child.topicMessages,
+			LastPayload: string(child.lastPayload),
+			LastSeen: child.lastSeen,
+			Rate: child.rate.perSecond(now),
+			Children: child.snapshot(path, now),
+		})
+	}
+
+	slices.SortFunc(nodes, func(a, b TopicTreeNode) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return nodes
+}
+
+func (r *rateCounter) add(at time.Time) {
+	second := at.Unix()
+	i := second % rateWindow
+	if r.seconds[i] != second {
+		r.seconds[i] = second
+		r.counts[i] = 0
+	}
+	r.counts[i]++
+}
+
+// Returns the average rate over the last rateWindow seconds.
+func (r *rateCounter) perSecond(now time.Time) float64 {
+	second := now.Unix()
+
+	total := 0
+	for i := range r.counts {
+		if age := second - r.seconds[i]; age >= 0 && age < rateWindow {
+			total += r.counts[i]
+		}
+	}
+
+	return float64(total) / float64(rateWindow)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pathSegment is one step of a value path, either an object key or an array
+// index. Negative indexes count from the end.
+type pathSegment struct {
+	key string
+	index int
+	isIndex bool
+}
+
+// Parses value paths in dot notation with array indexes, e.g.
+// "sensors[0].temp", "$.sensors[-1]['temp']" or "data.values[2]". An empty
+// path selects the whole payload.
+func parseValuePath(path string) ([]pathSegment, error) {
+	var segments []pathSegment
+
+	rest := strings.TrimSpace(path)
+	rest = strings.TrimPrefix(rest, "$")
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid value path %q: empty key", path)
+			}
+			segments = append(segments, pathSegment{key: rest[:end]})
+			rest = rest[end:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid value path %q: missing ]", path)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end + 1:]
+
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner) - 1] == inner[0] {
+				segments = append(segments, pathSegment{key: inner[1:len(inner) - 1]})
+				continue
+			}
+
+			index, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value path %q: %q is not an index", path, inner)
+			}
+			segments = append(segments, pathSegment{index: index, isIndex: true})
+		default:
+			// a leading key without a dot
+			if len(segments) > 0 {
+				return nil, fmt.Errorf("invalid value path %q", path)
+			}
+			rest = "." + rest
+		}
+	}
+
+	return segments, nil
+}
+
+// Returns the value the path selects in the JSON payload as text, strings
+// without quotes and objects or arrays as compact JSON. An empty path
+// returns the payload unchanged.
+func extractValue(payload []byte, path string) (string, error) {
+	if strings.TrimSpace(path) == "" {
+		return string(payload), nil
+	}
+
+	segments, err := parseValuePath(path)
+	if err != nil {
+		return "", err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber() // keeps numbers as they were sent
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("payload is not JSON: %w", err)
+	}
+
+	for _, segment := range segments {
+		switch current := value.(type) {
+		case map[string]any:
+			if segment.isIndex {
+				return "", fmt.Errorf("%s: expected an array", path)
+			}
+			child, found := current[segment.key]
+			if !found {
+				return "", fmt.Errorf("%s: key %q not found", path, segment.key)
+			}
+			value = child
+		case []any:
+			if !segment.isIndex {
+				return "", fmt.Errorf("%s: expected an object", path)
+			}
+			index := segment.index
+			if index < 0 {
+				index += len(current)
+			}
+			if index < 0 || index >= len(current) {
+				return "", fmt.Errorf("%s: index %d out of range", path, segment.index)
+			}
+			value = current[index]
+		default:
+			return "", fmt.Errorf("%s: cannot descend into %v", path, current)
+		}
+	}
+
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case nil:
+		return "null", nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseValuePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []pathSegment
+	}{
+		{"", nil},
+		{"temp", []pathSegment{{key: "temp"}}},
+		{"$.temp", []pathSegment{{key: "temp"}}},
+		{"sensors[0].temp", []pathSegment{{key: "sensors"}, {index: 0, isIndex: true}, {key: "temp"}}},
+		{"[1][-1]", []pathSegment{{index: 1, isIndex: true}, {index: -1, isIndex: true}}},
+		{"$['a.b'][\"c d\"]", []pathSegment{{key: "a.b"}, {key: "c d"}}},
+		{" data[ 2 ] ", []pathSegment{{key: "data"}, {index: 2, isIndex: true}}},
+	}
+
+	for _, test := range tests {
+		got, err := parseValuePath(test.path)
+		if err != nil {
+			t.Errorf("%q: %v", test.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestParseValuePathErrors(t *testing.T) {
+	tests := []struct {
+		path string
+		err string
+	}{
+		{"a..b", "empty key"},
+		{"a.", "empty key"},
+		{"a[0", "missing ]"},
+		{"a[x]", "is not an index"},
+		{"a[]", "is not an index"},
+		{"a['b]", "is not an index"},
+		{"a[0]b", "invalid value path"},
+	}
+
+	for _, test := range tests {
+		_, err := parseValuePath(test.path)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %q", test.path, err, test.err)
+		}
+	}
+}
+
+func TestExtractValue(t *testing.T) {
+	payload := `{
+		"name": "pump",
+		"on": true,
+		"error": null,
+		"count": 12345678901234567890,
+		"temp": 21.50,
+		"sensors": [{"temp": 20}, {"temp": 22, "tags": ["a", "b"]}],
+		"matrix": [[1, 2], [3, [4, 5]]],
+		"a.b": {"c": "dotted"}
+	}`
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"name", "pump"},
+		{"on", "true"},
+		{"error", "null"},
+		{"count", "12345678901234567890"},
+		{"temp", "21.50"},
+		{"sensors[1].temp", "22"},
+		{"sensors[-1].tags[0]", "a"},
+		{"sensors[0]", `{"temp":20}`},
+		{"matrix[1][1][0]", "4"},
+		{"matrix[-1][-1]", "[4,5]"},
+		{"['a.b'].c", "dotted"},
+		{"$", `{"a.b":{"c":"dotted"},"count":12345678901234567890,"error":null,"matrix":[[1,2],[3,[4,5]]],"name":"pump","on":true,"sensors":[{"temp":20},{"tags":["a","b"],"temp":22}],"temp":21.50}`},
+	}
+
+	for _, test := range tests {
+		got, err := extractValue([]byte(payload), test.path)
+		if err != nil {
+			t.Errorf("%q: %v", test.path, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %s, want %s", test.path, got, test.want)
+		}
+	}
+}
+
+func TestExtractValueErrors(t *testing.T) {
+	payload := `{"sensors": [{"temp": 20}], "name": "pump"}`
+
+	tests := []struct {
+		path string
+		err string
+	}{
+		{"missing", `key "missing" not found`},
+		{"sensors[0].hum", `key "hum" not found`},
+		{"sensors[1]", "index 1 out of range"},
+		{"sensors[-2]", "index -2 out of range"},
+		{"sensors.temp", "expected an object"},
+		{"[0]", "expected an array"},
+		{"name.first", "cannot descend"},
+		{"a..b", "empty key"},
+	}
+
+	for _, test := range tests {
+		_, err := extractValue([]byte(payload), test.path)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %q", test.path, err, test.err)
+		}
+	}
+
+	if _, err := extractValue([]byte("on"), "temp"); err == nil {
+		t.Error("got no error for a payload that is not JSON")
+	}
+
+	// without a path the payload is not parsed
+	if got, err := extractValue([]byte("21.5 C"), " "); err != nil || got != "21.5 C" {
+		t.Errorf("got %q, %v, want the payload unchanged", got, err)
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Loads every widget of the project with its config parsed into the typed
+// config struct of the widget.
+func getProjectWidgets(db *sql.DB, projectID int) ([]ProjectWidget, error) {
+	rows, err := db.Query(`SELECT project_widgets.id, project_widgets.project_section_id, project_widgets.title, project_widgets.widget, project_widgets.config
+		FROM project_widgets
+		INNER JOIN project_sections ON project_sections.id = project_widgets.project_section_id
+		WHERE project_sections.project_id = ?
+		ORDER BY project_widgets.id`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projectWidgets []ProjectWidget
+	for rows.Next() {
+		var projectWidget ProjectWidget
+
+		err = rows.Scan(&projectWidget.ID, &projectWidget.ProjectSectionID, &projectWidget.Title, &projectWidget.Widget, &projectWidget.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		projectWidget.ConfigParsed, err = parseWidgetConfig(projectWidget.Widget, projectWidget.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		projectWidgets = append(projectWidgets, projectWidget)
+	}
+
+	return projectWidgets, rows.Err()
+}
+
+func parseWidgetConfig(widget string, config []byte) (any, error) {
+	if len(config) == 0 {
+		return nil, nil
+	}
+
+	switch widget {
+	case "TEXT":
+		var textWidgetConfig TextWidgetConfig
+		err := json.Unmarshal(config, &textWidgetConfig)
+		return textWidgetConfig, err
+	case "INDICATOR":
+		var indicatorWidgetConfig IndicatorWidgetConfig
+		err := json.Unmarshal(config, &indicatorWidgetConfig)
+		return indicatorWidgetConfig, err
+	case "BUTTON":
+		var buttonWidgetConfig ButtonWidgetConfig
+		err := json.Unmarshal(config, &buttonWidgetConfig)
+		return buttonWidgetConfig, err
+	case "REQUEST":
+		var requestWidgetConfig RequestWidgetConfig
+		err := json.Unmarshal(config, &requestWidgetConfig)
+		return requestWidgetConfig, err
+	case "TABLE":
+		var tableWidgetConfig TableWidgetConfig
+		err := json.Unmarshal(config, &tableWidgetConfig)
+		return tableWidgetConfig, err
+	case "INPUT":
+		var inputWidgetConfig InputWidgetConfig
+		err := json.Unmarshal(config, &inputWidgetConfig)
+		return inputWidgetConfig, err
+	case "SWITCH":
+		var switchWidgetConfig SwitchWidgetConfig
+		err := json.Unmarshal(config, &switchWidgetConfig)
+		return switchWidgetConfig, err
+	case "SLIDER":
+		var sliderWidgetConfig SliderWidgetConfig
+		err := json.Unmarshal(config, &sliderWidgetConfig)
+		return sliderWidgetConfig, err
+	case "GAUGE":
+		var gaugeWidgetConfig GaugeWidgetConfig
+		err := json.Unmarshal(config, &gaugeWidgetConfig)
+		return gaugeWidgetConfig, err
+	case "TIMESERIES-LINE-CHART":
+		var timeseriesLineChartWidgetConfig TimeseriesLineChartWidgetConfig
+		err := json.Unmarshal(config, &timeseriesLineChartWidgetConfig)
+		timeseriesLineChartWidgetConfig.migrate()
+		return timeseriesLineChartWidgetConfig, err
+	}
+
+	return nil, nil
+}
+
+// Returns the topics the widget needs to be subscribed to.
+func getWidgetTopics(projectWidget ProjectWidget) []string {
+	var topics []string
+
+	switch config := projectWidget.ConfigParsed.(type) {
+	case TextWidgetConfig:
+		topics = append(topics, config.Topic)
+	case IndicatorWidgetConfig:
+		topics = append(topics, config.Topic)
+	case RequestWidgetConfig:
+		topics = append(topics, config.ResponseTopic)
+	case TableWidgetConfig:
+		topics = append(topics, config.Topic)
+	case GaugeWidgetConfig:
+		topics = append(topics, config.Topic)
+	case SliderWidgetConfig:
+		topics = append(topics, config.StateTopic)
+	case SwitchWidgetConfig:
+		topics = append(topics, config.StateTopic)
+	case TimeseriesLineChartWidgetConfig:
+		topics = append(topics, config.Topics()...)
+	}
+
+	var nonEmptyTopics []string
+	for _, topic := range topics {
+		if topic != "" {
+			nonEmptyTopics = append(nonEmptyTopics, topic)
+		}
+	}
+
+	return nonEmptyTopics
+}
+
+// Returns the QoS the widget subscribes or publishes with.
+func getWidgetQoS(projectWidget ProjectWidget) byte {
+	switch config := projectWidget.ConfigParsed.(type) {
+	case TextWidgetConfig:
+		return config.QoS
+	case IndicatorWidgetConfig:
+		return config.QoS
+	case ButtonWidgetConfig:
+		return config.QoS
+	case RequestWidgetConfig:
+		return config.QoS
+	case TableWidgetConfig:
+		return config.QoS
+	case GaugeWidgetConfig:
+		return config.QoS
+	case SliderWidgetConfig:
+		return config.QoS
+	case SwitchWidgetConfig:
+		return config.QoS
+	case InputWidgetConfig:
+		return config.QoS
+	case TimeseriesLineChartWidgetConfig:
+		return config.QoS
+	}
+
+	return 0
+}
+
+// Reports whether the message on the topic concerns the widget, widget
+// topics may be filters.
+func widgetMatchesTopic(projectWidget ProjectWidget, topic string) bool {
+	for _, filter := range getWidgetTopics(projectWidget) {
+		if topicMatches(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the topics of all widgets mapped to the QoS they are subscribed
+// with, topics shared by several widgets use the highest QoS.
+func getProjectSubscriptions(projectWidgets []ProjectWidget) map[string]byte {
+	subscriptions := map[string]byte{}
+
+	for _, projectWidget := range projectWidgets {
+		qos := getWidgetQoS(projectWidget)
+		for _, topic := range getWidgetTopics(projectWidget) {
+			if current, exists := subscriptions[topic]; !exists || qos > current {
+				subscriptions[topic] = qos
+			}
+		}
+	}
+
+	return subscriptions
+}
+
+// Unsubscribes the topics of changed or deleted widgets that no widget of the
+// project subscribes to anymore.
+func unsubscribeUnusedTopics(db *sql.DB, connections *ConnectionManager, projectID int, topics []string) error {
+	projectWidgets, err := getProjectWidgets(db, projectID)
+	if err != nil {
+		return err
+	}
+
+	subscriptions := getProjectSubscriptions(projectWidgets)
+	for _, topic := range topics {
+		if _, used := subscriptions[topic]; used {
+			continue
+		}
+		if err := connections.Unsubscribe(projectID, topic); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Publishing widgets need a plain topic, the others may subscribe to a topic
+// filter.
+func validateWidgetTopic(widget string, topic string) error {
+	switch widget {
+	case "BUTTON", "REQUEST", "SLIDER", "SWITCH", "INPUT":
+		return validatePublishTopic(topic)
+	}
+
+	return validateTopicFilter(topic)
+}
+
+// Parses the QoS field of the widget forms, empty means QoS 0.
+func parseQoS(value string) (byte, error) {
+	switch value {
+	case "", "0":
+		return 0, nil
+	case "1":
+		return 1, nil
+	case "2":
+		return 2, nil
+	}
+
+	return 0, fmt.Errorf("invalid QoS %q, must be 0, 1 or 2", value)
+}
+
+// Parses a number field of the widget forms, empty means the fallback.
+func parseNumberField(text string, fallback float64) (float64, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return fallback, nil
+	}
+
+	number, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, fmt.Errorf("%q is not a number", text)
+	}
+
+	return number, nil
+}
+
+// Builds the value shown by the widget from the live buffer or, for charts,
+// from the data logs. Payloads pass the decoders before the value path.
+func getWidgetData(db *sql.DB, connection *Connection, decoders *PayloadDecoders, projectWidget ProjectWidget) (WidgetData, error) {
+	widgetData := WidgetData{
+		ID: projectWidget.ID,
+	}
+
+	transform, err := compileExpression(getWidgetTransform(projectWidget))
+	if err != nil {
+		widgetData.Error = err.Error()
+		return widgetData, nil
+	}
+
+	switch config := projectWidget.ConfigParsed.(type) {
+	case TextWidgetConfig:
+		if message, found := connection.LatestMessage(config.Topic); found {
+			widgetData.Data, widgetData.Error = widgetValue(decoders, message, config.ValuePath, transform)
+		}
+	case IndicatorWidgetConfig:
+		if message, found := connection.LatestMessage(config.Topic); found {
+			value, err := decodeValue(decoders, message.Topic, message.Payload, config.ValuePath, transform)
+			if err != nil {
+				widgetData.Error = err.Error()
+				break
+			}
+
+			on, err := indicatorState(config.OnCondition, message.Topic, value)
+			if err != nil {
+				widgetData.Error = err.Error()
+				break
+			}
+
+			widgetData.Data = IndicatorWidgetData{
+				Value: value,
+				On: on,
+			}
+		}
+	case RequestWidgetConfig:
+		if result, found := connection.RequestResult(projectWidget.ID); found {
+			if result.Error == "" {
+				value, err := decodeValue(decoders, config.ResponseTopic, []byte(result.Payload), config.ValuePath, transform)
+				if err != nil {
+					result.Error = err.Error()
+				}
+				result.Payload = value
+			}
+			widgetData.Data = result
+		}
+	case TableWidgetConfig:
+		rows := []TableWidgetRow{}
+		for _, message := range connection.MatchingMessages(config.Topic) {
+			// topics without the value are left out
+			value, err := decodeValue(decoders, message.Topic, message.Payload, config.ValuePath, transform)
+			if err != nil {
+				continue
+			}
+
+			rows = append(rows, TableWidgetRow{
+				Topic: message.Topic,
+				Payload: value,
+				ReceivedAt: message.ReceivedAt,
+			})
+		}
+		widgetData.Data = rows
+	case GaugeWidgetConfig:
+		if message, found := connection.LatestMessage(config.Topic); found {
+			value, err := decodeValue(decoders, message.Topic, message.Payload, config.ValuePath, transform)
+			if err != nil {
+				widgetData.Error = err.Error()
+				break
+			}
+
+			data, err := config.Data(value, message.ReceivedAt)
+			if err != nil {
+				widgetData.Error = err.Error()
+				break
+			}
+			widgetData.Data = data
+		}
+	case SwitchWidgetConfig:
+		data, err := getSwitchData(connection, decoders, projectWidget, config, transform)
+		if err != nil {
+			widgetData.Error = err.Error()
+			break
+		}
+		if data != nil {
+			widgetData.Data = data
+		}
+	case SliderWidgetConfig:
+		if config.StateTopic == "" {
+			break
+		}
+
+		if message, found := connection.LatestMessage(config.StateTopic); found {
+			value, err := decodeValue(decoders, message.Topic, message.Payload, config.ValuePath, transform)
+			if err != nil {
+				widgetData.Error = err.Error()
+				break
+			}
+
+			data, err := config.Data(value)
+			if err != nil {
+				widgetData.Error = err.Error()
+				break
+			}
+			widgetData.Data = data
+		}
+	case TimeseriesLineChartWidgetConfig:
+		// every series has its own transform
+		transforms := make([]*Expression, len(config.Series))
+		for i, series := range config.Series {
+			transforms[i], err = compileExpression(series.Transform)
+			if err != nil {
+				widgetData.Error = fmt.Sprintf("%s: %v", series.Topic, err)
+				return widgetData, nil
+			}
+		}
+
+		data, err := getChartData(db, connection.ProjectID, decoders, config, transforms)
+		if err != nil {
+			return widgetData, err
+		}
+		widgetData.Data = data
+	}
+
+	return widgetData, nil
+}
+
+// Decodes the payload, selects the value path and applies the transform.
+func decodeValue(decoders *PayloadDecoders, topic string, payload []byte, valuePath string, transform *Expression) (string, error) {
+	decoded, err := decoders.Decode(topic, payload)
+	if err != nil {
+		return "", err
+	}
+
+	value, err := extractValue(decoded, valuePath)
+	if err != nil {
+		return "", err
+	}
+
+	return transform.Apply(topic, value)
+}
+
+// Returns the value shown by a widget, or the reason the payload could not
+// be decoded, did not contain the value path or failed the transform.
+func widgetValue(decoders *PayloadDecoders, message Message, valuePath string, transform *Expression) (any, string) {
+	value, err := decodeValue(decoders, message.Topic, message.Payload, valuePath, transform)
+	if err != nil {
+		return nil, err.Error()
+	}
+
+	return value, ""
+}
+
+// Returns the plotted value, nil leaves a gap in the chart.
+func chartValue(decoders *PayloadDecoders, dataLog DataLog, valuePath string, transform *Expression) any {
+	value, err := decodeValue(decoders, dataLog.Topic, dataLog.Data, valuePath, transform)
+	if err != nil {
+		return nil
+	}
+
+	return value
+}
+
+// Returns the transform expression of subscribing widgets, the series of
+// charts have their own.
+func getWidgetTransform(projectWidget ProjectWidget) string {
+	switch config := projectWidget.ConfigParsed.(type) {
+	case TextWidgetConfig:
+		return config.Transform
+	case IndicatorWidgetConfig:
+		return config.Transform
+	case RequestWidgetConfig:
+		return config.Transform
+	case TableWidgetConfig:
+		return config.Transform
+	case GaugeWidgetConfig:
+		return config.Transform
+	case SliderWidgetConfig:
+		return config.Transform
+	case SwitchWidgetConfig:
+		return config.Transform
+	}
+
+	return ""
+}
+
+// Publishes the value of an input widget, buttons always send their
+// configured message and request widgets wait for the reply.
+func publishWidgetValue(connection *Connection, projectWidget ProjectWidget, value string) error {
+	switch config := projectWidget.ConfigParsed.(type) {
+	case ButtonWidgetConfig:
+		return connection.SendMessage(Message{
+			Topic: config.Topic,
+			Payload: []byte(config.Message),
+			QoS: config.QoS,
+			Retained: config.Retain,
+			Properties: config.MessageProperties(),
+		})
+	case SliderWidgetConfig:
+		payload, err := config.Payload(value)
+		if err != nil {
+			return err
+		}
+
+		return connection.SendMessage(Message{
+			Topic: config.Topic,
+			Payload: []byte(payload),
+			QoS: config.QoS,
+			Retained: config.Retain,
+			Properties: config.MessageProperties(),
+		})
+	case SwitchWidgetConfig:
+		return sendSwitchCommand(connection, projectWidget, config, value)
+	case InputWidgetConfig:
+		payload, err := config.Payload(value)
+		if err != nil {
+			return err
+		}
+
+		return connection.SendMessage(Message{
+			Topic: config.Topic,
+			Payload: payload,
+			QoS: config.QoS,
+			Retained: config.Retain,
+			Properties: config.MessageProperties(),
+		})
+	case RequestWidgetConfig:
+		return sendWidgetRequest(connection, projectWidget, config)
+	}
+
+	return fmt.Errorf("widget %d does not publish", projectWidget.ID)
+}
+
+// Reads the content type and user properties fields of the publishing
+// widget forms.
+func parsePublishProperties(r *http.Request) (PublishProperties, error) {
+	userProperties, err := parseUserProperties(r.FormValue("user-properties"))
+	if err != nil {
+		return PublishProperties{}, err
+	}
+
+	return PublishProperties{
+		ContentType: strings.TrimSpace(r.FormValue("content-type")),
+		UserProperties: userProperties,
+	}, nil
+}
+
+// Returns the properties of the published messages, nil when the widget sets
+// none.
+func (p PublishProperties) MessageProperties() *MessageProperties {
+	if p.ContentType == "" && len(p.UserProperties) == 0 {
+		return nil
+	}
+
+	return &MessageProperties{
+		ContentType: p.ContentType,
+		UserProperties: p.UserProperties,
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/gorilla/websocket"
+)
+
+// the default origin check only accepts same host requests
+var upgrader = websocket.Upgrader{
+	ReadBufferSize: 1024,
+	WriteBufferSize: 1024,
+}
+
+// Frame sent to the dashboard, Type is one of status, data, buffer, message,
+// ack or error.
+type SocketFrame struct {
+	Type string `json:"type"`
+	ID string `json:"id,omitempty"`
+	Data any `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Command sent by the dashboard, every publish is answered with an ack
+// frame carrying the same ID.
+type SocketCommand struct {
+	Type string `json:"type"`
+	ID string `json:"id"`
+	Widget int `json:"widget"`
+	Value string `json:"value"`
+}
+
+type SocketMessage struct {
+	Topic string `json:"topic"`
+	Payload string `json:"payload"`
+	QoS byte `json:"qos"`
+	Retained bool `json:"retained"`
+	Properties *MessageProperties `json:"properties,omitempty"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	Decoded string `json:"decoded,omitempty"`
+}
+
+// Bidirectional dashboard channel, it pushes the same updates as the event
+// stream and accepts publish commands of the project widgets.
+func projectSocketHandler(db *sql.DB, connections *ConnectionManager, store *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "mqtt-studio-session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		project, err := GetProjectBySlug(db, r.PathValue("slug"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		projectWidgets, err := getProjectWidgets(db, project.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		decoders, err := newPayloadDecoders(project)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		socket, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader already replied with an error
+			return
+		}
+		defer socket.Close()
+
+		connection, events, cancel := connections.Listen(project.ID)
+		defer cancel()
+
+		widgets := newLiveWidgets(projectWidgets, decoders)
+
+		// gorilla allows one writer at a time, so commands are read here and
+		// every frame is written by the loop below
+		commands := make(chan SocketCommand)
+		closed := make(chan struct{})
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			defer close(closed)
+			for {
+				var command SocketCommand
+				if err := socket.ReadJSON(&command); err != nil {
+					return
+				}
+
+				select {
+				case commands <- command:
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		acks := make(chan SocketFrame, 16)
+
+		socket.WriteJSON(SocketFrame{Type: "status", Data: connection.StatusText()})
+		lastUsage := connection.BufferUsage()
+		socket.WriteJSON(SocketFrame{Type: "buffer", Data: lastUsage})
+
+		flushTicker := time.NewTicker(100 * time.Millisecond)
+		defer flushTicker.Stop()
+
+		usageTicker := time.NewTicker(2 * time.Second)
+		defer usageTicker.Stop()
+
+		pingTicker := time.NewTicker(15 * time.Second)
+		defer pingTicker.Stop()
+
+		for {
+			var err error
+
+			select {
+			case <-closed:
+				return
+			case command := <-commands:
+				if command.Type != "publish" {
+					err = socket.WriteJSON(SocketFrame{Type: "error", ID: command.ID, Error: "unknown command " + command.Type})
+					break
+				}
+
+				projectWidget, found := widgets.Find(command.Widget)
+				if !found {
+					err = socket.WriteJSON(SocketFrame{Type: "ack", ID: command.ID, Error: "widget not found"})
+					break
+				}
+
+				// waiting for the broker must not block the live updates
+				go func() {
+					ack := SocketFrame{Type: "ack", ID: command.ID}
+					if err := publishWidgetValue(connection, projectWidget, command.Value); err != nil {
+						ack.Error = err.Error()
+					}
+
+					select {
+					case acks <- ack:
+					case <-done:
+					}
+				}()
+			case ack := <-acks:
+				err = socket.WriteJSON(ack)
+			case event := <-events:
+				if event.Type == EventStatus {
+					err = socket.WriteJSON(SocketFrame{Type: "status", Data: event.Status})
+					break
+				}
+
+				if event.Type == EventRequest || event.Type == EventSwitch {
+					widgets.TouchWidget(event.WidgetID)
+					break
+				}
+
+				if !widgets.Subscribed(event.Message.Topic) {
+					break
+				}
+
+				widgets.Touch(event.Message.Topic)
+				err = socket.WriteJSON(SocketFrame{Type: "message", Data: SocketMessage{
+					Topic: event.Message.Topic,
+					Payload: string(event.Message.Payload),
+					QoS: event.Message.QoS,
+					Retained: event.Message.Retained,
+					Properties: event.Message.Properties,
+					ReceivedAt: event.Message.ReceivedAt,
+				}})
+			case <-flushTicker.C:
+				if !widgets.Dirty() {
+					break
+				}
+
+				data, collectErr := widgets.Collect(db, connection)
+				if collectErr != nil {
+					socket.WriteJSON(SocketFrame{Type: "error", Error: collectErr.Error()})
+				}
+				err = socket.WriteJSON(SocketFrame{Type: "data", Data: data})
+			case <-usageTicker.C:
+				usage := connection.BufferUsage()
+				if usage != lastUsage {
+					err = socket.WriteJSON(SocketFrame{Type: "buffer", Data: usage})
+					lastUsage = usage
+				}
+			case <-pingTicker.C:
+				err = socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(5 * time.Second))
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}
+}